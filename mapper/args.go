@@ -0,0 +1,65 @@
+package mapper
+
+import (
+	`database/sql/driver`
+	`encoding/json`
+	`fmt`
+	`github.com/lib/pq`
+	`reflect`
+	`time`
+)
+
+const (
+	cannotMarshalArgErr = `cannot marshal argument %v into json, err=%v`
+	queryArgErr         = `a subquery can only be an argument of a condition or of Update`
+)
+
+var timeReflectType = reflect.TypeOf(time.Time{})
+
+// toSQLArgs converts query arguments into values the driver can send
+func toSQLArgs(args []interface{}) ([]interface{}, error) {
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		var err error
+		if converted[i], err = toSQLArg(arg); err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// toSQLArg marshals maps and structs (and pointers to them) into json, to be stored in json/jsonb columns,
+// and wraps slices into postgres arrays, so that `= ANY(?)` works with a single slice
+// Values the driver already knows (time.Time, sql.NullString, []byte etc) are left alone
+// Subqueries are inlined by bindArgs, any left (Insert values etc) would be marshalled as an empty object
+func toSQLArg(arg interface{}) (interface{}, error) {
+	switch v := arg.(type) {
+	case nil, driver.Valuer, time.Time, *time.Time, []byte:
+		return arg, nil
+	case json.RawMessage:
+		// send as text, a []byte would be sent as bytea
+		return string(v), nil
+	case *Query:
+		return nil, fmt.Errorf(queryArgErr)
+	}
+
+	argType := reflect.TypeOf(arg)
+	if argType.Kind() == reflect.Slice {
+		return pq.Array(arg), nil
+	}
+	if argType.Kind() == reflect.Ptr {
+		if reflect.ValueOf(arg).IsNil() {
+			return nil, nil
+		}
+		argType = argType.Elem()
+	}
+	if argType.Kind() != reflect.Map && (argType.Kind() != reflect.Struct || argType == timeReflectType) {
+		return arg, nil
+	}
+
+	raw, err := json.Marshal(arg)
+	if err != nil {
+		return nil, fmt.Errorf(cannotMarshalArgErr, arg, err)
+	}
+	return string(raw), nil
+}
@@ -0,0 +1,63 @@
+package mapper
+
+import (
+	`database/sql`
+	`encoding/json`
+	`github.com/lib/pq`
+	`gopkg.in/check.v1`
+	`time`
+)
+
+type ArgsTS struct{}
+
+func init() {
+	check.Suite(&ArgsTS{})
+}
+
+type testMeta struct {
+	Source string `json:"source"`
+}
+
+func (s *ArgsTS) TestToSQLArg(c *check.C) {
+	now := time.Now()
+	var tests = []struct {
+		in, out interface{}
+	}{
+		{nil, nil},
+		{`text`, `text`},
+		{int64(1), int64(1)},
+		{now, now},
+		{&now, &now},
+		{[]byte{1, 2}, []byte{1, 2}},
+		{sql.NullString{Valid: true, String: `a`}, sql.NullString{Valid: true, String: `a`}},
+		{json.RawMessage(`{"a":1}`), `{"a":1}`},
+		{map[string]interface{}{`a`: 1}, `{"a":1}`},
+		{testMeta{`api`}, `{"source":"api"}`},
+		{&testMeta{`api`}, `{"source":"api"}`},
+		{(*testMeta)(nil), nil},
+		{[]string{`a`, `b`}, pq.Array([]string{`a`, `b`})},
+		{[]int64{1}, pq.Array([]int64{1})},
+	}
+	for _, test := range tests {
+		out, err := toSQLArg(test.in)
+		c.Assert(err, check.IsNil)
+		c.Assert(out, check.DeepEquals, test.out)
+	}
+
+	_, err := toSQLArg(map[string]interface{}{`a`: func() {}})
+	c.Assert(err, check.ErrorMatches, `cannot marshal argument .* into json, err=.*`)
+
+	sub := Select(`t_roles.id`).From(`t_roles`)
+	_, err = toSQLArg(sub)
+	c.Assert(err, check.ErrorMatches, `a subquery can only be an argument of a condition or of Update`)
+	c.Assert(Insert(`t_users`, `id, role_id`, `1u`, sub).err, check.ErrorMatches, `a subquery can only be .*`)
+	c.Assert(BulkInsert(`t_users`, `id, role_id`, [][]interface{}{{`1u`, sub}}).err, check.ErrorMatches, `a subquery can only be .*`)
+}
+
+func (s *ArgsTS) TestBuildError(c *check.C) {
+	q := Insert(`t_events`, `id, data`, 1, map[string]interface{}{`a`: make(chan int)})
+	c.Assert(q.err, check.NotNil)
+
+	_, err := q.Run()
+	c.Assert(err, check.Equals, q.err)
+}
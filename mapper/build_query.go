@@ -1,79 +1,273 @@
 package mapper
 
 import (
-	`database/sql`
+	`context`
 	`fmt`
+	`github.com/lib/pq`
+	`regexp`
 	`strings`
 )
 
 var (
-	selectTemplate   = `SELECT %s`
-	fromTemplate     = `%s FROM %s`
-	fromJoinTemplate = `%s FROM %s %s %s ON %s`
-	whereTemplate    = `%s WHERE %s`
-	argTemplate      = `$%v`
-	limitTemplate    = `%s LIMIT %d`
-	orderTemplate    = `%s ORDER BY %s %s`
-	insertTemplate   = `INSERT INTO %s (%s) VALUES (%s)`
-	updateTemplate   = `UPDATE %s SET %s`
-	deleteTemplate   = `DELETE FROM %s`
-	truncateTemplate = `TRUNCATE %s`
+	selectTemplate     = `SELECT %s`
+	fromTemplate       = `%s FROM %s`
+	joinTemplate       = `%s %s %s ON %s`
+	crossJoinTemplate  = `%s %s %s`
+	whereTemplate      = `%s WHERE %s`
+	groupByTemplate    = `%s GROUP BY %s`
+	havingTemplate     = `%s HAVING %s`
+	argTemplate        = `$%v`
+	limitTemplate      = `%s LIMIT %d`
+	orderTemplate      = `%s ORDER BY %s`
+	orderFieldTemplate = `%s %s`
+	insertTemplate     = `INSERT INTO %s (%s) VALUES (%s)`
+	updateTemplate     = `UPDATE %s SET %s`
+	deleteTemplate     = `DELETE FROM %s`
+	truncateTemplate   = `TRUNCATE %s`
+	returningTemplate  = `%s RETURNING %s`
 )
 
-var dbconnection *sql.DB
+const (
+	returningErr     = `RETURNING can only be used with insert, bulk insert, update and delete queries`
+	noReturningErr   = `RETURNING needs at least 1 field`
+	whereTypeErr     = `where conditions must be a string or a Predicate, got %T`
+	predicateArgsErr = `arguments of a Predicate are given to Eq, In, etc, not to Where`
+)
+
+var (
+	identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)*$`)
+)
+
+// quoteIdentifier quotes a table or column name ("schema.table.column" -> "schema"."table"."column")
+// with pq.QuoteIdentifier. Other strings (`*`, expressions like `count(*)`) are left alone:
+// builders only take them when they are declared in the query, or registered, see Mapper.checkQuery
+func quoteIdentifier(name string) string {
+	if !identifierPattern.MatchString(name) {
+		return name
+	}
+	parts := strings.Split(name, `.`)
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, `.`)
+}
+
+// quoteIdentifiers quotes a list of names
+func quoteIdentifiers(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name)
+	}
+	return quoted
+}
 
-// Connect register a db connection to the module. Must be called to init mapper
-func Connect(conn *sql.DB) {
-	dbconnection = conn
+// splitFields splits a list of fields ("id, name, required_karma")
+func splitFields(fields string) []string {
+	fieldList := strings.Split(fields, `,`)
+	for i := range fieldList {
+		fieldList[i] = strings.TrimSpace(fieldList[i])
+	}
+	return fieldList
 }
 
 // Select starts the creation of a select query
-func Select(fields ...string) *Query {
-	return &Query{
-		queryType:    SelectQuery,
-		query:        fmt.Sprintf(selectTemplate, strings.Join(fields, `, `)),
-		selectFields: fields,
+// Table and field names given to the builders are quoted, and must be registered (or declared in the query),
+// otherwise Run fails. Conditions given as strings (Where, Join, Update) are used as they are
+func (m *Mapper) Select(fields ...string) *Query {
+	exprs := make([]Expression, len(fields))
+	for i, field := range fields {
+		exprs[i] = Column(field)
 	}
+	return m.SelectExpr(exprs...)
 }
 
-// From indicates a table for the query
+// SelectExpr starts the creation of a select query which fields are Expressions (As, Expr, Count, etc),
+// their values are keyed by their alias. Use Column for the plain columns
+func (m *Mapper) SelectExpr(fields ...Expression) *Query {
+	q := &Query{
+		mapper:    m,
+		queryType: SelectQuery,
+	}
+	sqlFields := make([]string, 0, len(fields))
+	for _, f := range fields {
+		sqlFields = append(sqlFields, f.String())
+		q.selectFields = append(q.selectFields, f.key())
+		if f.isColumn() {
+			continue
+		}
+		q.fields = append(q.fields, f.fields...)
+		q.addExpression(f)
+	}
+	q.query = fmt.Sprintf(selectTemplate, strings.Join(sqlFields, `, `))
+	return q
+}
+
+// addExpression records how to type the value of a select field that isn't a plain column
+func (q *Query) addExpression(e Expression) {
+	if e.colType == invalidType {
+		if q.aliases == nil {
+			q.aliases = map[string]string{}
+		}
+		q.aliases[e.key()] = e.name
+		return
+	}
+	if q.exprTypes == nil {
+		q.exprTypes = map[string]int{}
+	}
+	q.exprTypes[e.key()] = e.colType
+}
+
+// Select starts the creation of a select query on the default mapper
+func Select(fields ...string) *Query {
+	return defaultMapper.Select(fields...)
+}
+
+// SelectExpr starts the creation of a select query of Expressions on the default mapper
+func SelectExpr(fields ...Expression) *Query {
+	return defaultMapper.SelectExpr(fields...)
+}
+
+// From indicates a table for the query, which can be qualified by a schema ("audit.users")
+// With Configuration.SearchPath set, an unqualified table is qualified by the schema it was registered in
 func (q *Query) From(table string) *Query {
-	q.query = fmt.Sprintf(fromTemplate, q.query, table)
+	tb := q.resolveTable(table)
+	q.query = fmt.Sprintf(fromTemplate, q.query, quoteIdentifier(tb.String()))
+	q.tables = append(q.tables, tb)
 	return q
 }
 
+// resolveTable qualifies a table the query reads from, the queries of its WITH clause are not tables
+func (q *Query) resolveTable(table string) tableName {
+	if q.with != nil && q.with.query(table) != nil {
+		return parseTable(table)
+	}
+	return q.getMapper().resolveTable(table)
+}
+
 const (
 	InnerJoin = iota
+	LeftJoin
+	RightJoin
+	FullJoin
+	CrossJoin
 )
 
 var (
 	joinWords = map[int]string{
 		InnerJoin: `INNER JOIN`,
+		LeftJoin:  `LEFT JOIN`,
+		RightJoin: `RIGHT JOIN`,
+		FullJoin:  `FULL JOIN`,
+		CrossJoin: `CROSS JOIN`,
 	}
 )
 
-// FromJoin indicates a joint of tables as the source, for now only take cares of 2 table join
+// FromJoin indicates a joint of 2 tables as the source, chain Join for more
 func (q *Query) FromJoin(joinType int, first, second, conditions string) *Query {
-	q.query = fmt.Sprintf(fromJoinTemplate, q.query, first, joinWords[joinType], second, conditions)
+	return q.From(first).Join(joinType, second, conditions)
+}
+
+// Join adds a table to the source of the query, it can be called repeatedly after From / FromJoin
+// conditions is ignored for CrossJoin. Columns from the nullable side of outer joins
+// (the new table for LeftJoin, the tables before it for RightJoin, both for FullJoin) are returned as nullable
+func (q *Query) Join(joinType int, table, conditions string) *Query {
+	tb := q.resolveTable(table)
+	if joinType == CrossJoin {
+		q.query = fmt.Sprintf(crossJoinTemplate, q.query, joinWords[joinType], quoteIdentifier(tb.String()))
+	} else {
+		q.query = fmt.Sprintf(joinTemplate, q.query, joinWords[joinType], quoteIdentifier(tb.String()), conditions)
+	}
+
+	if joinType == RightJoin || joinType == FullJoin {
+		for i := range q.tables {
+			q.tables[i].outer = true
+		}
+	}
+	tb.outer = joinType == LeftJoin || joinType == FullJoin
+	q.tables = append(q.tables, tb)
 	return q
 }
 
-const (
-	placeHolder = `?`
-)
+// addArgs converts and appends arguments to the query, maps and structs are marshalled into json
+func (q *Query) addArgs(args []interface{}) {
+	converted, err := toSQLArgs(args)
+	if err != nil {
+		q.setErr(err)
+	}
+	q.args = append(q.args, converted...)
+}
+
+// setErr records an error found while building the query, only the first one is kept
+func (q *Query) setErr(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// Where adds a condition to the where clause of the query, repeated calls are combined with AND
+// The condition is either a string using ? for place holders, with its args (json operators ->, ->>, #>, @>, etc
+// can be used around them, assume no of `?` in conditions & no of args is the same), or a Predicate (Eq, In, And, etc)
+// An arg can be a *Query, used as a subquery: Where(`t_users.id IN ?`, Select(`t_user_roles.user_id`).From(...))
+func (q *Query) Where(condition interface{}, args ...interface{}) *Query {
+	if p, ok := q.bindCondition(condition, args); ok {
+		q.where = append(q.where, p)
+	}
+	return q
+}
+
+// bindCondition makes a predicate of a where / having condition, binds its place holders and adds its args
+func (q *Query) bindCondition(condition interface{}, args []interface{}) (Predicate, bool) {
+	var p Predicate
+	switch c := condition.(type) {
+	case string:
+		p = Raw(c, args...)
+	case Predicate:
+		if len(args) > 0 {
+			q.setErr(fmt.Errorf(predicateArgsErr))
+			return p, false
+		}
+		p = c
+	default:
+		q.setErr(fmt.Errorf(whereTypeErr, condition))
+		return p, false
+	}
 
-// Where construct the where clause of the query and add arugments for it
-// use ? for place holders
-// assume no of `?` in conditions & no of args is the same
-func (q *Query) Where(conditions string, args ...interface{}) *Query {
-	parts := strings.Split(conditions, placeHolder)
-	final := make([]string, 0, len(parts)*2)
-	start := len(q.args) + 1
-	for offset := range args {
-		final = append(final, parts[offset], fmt.Sprintf(argTemplate, start+offset))
-	}
-	q.query = fmt.Sprintf(whereTemplate, q.query, strings.Join(final, ``))
-	q.args = append(q.args, args...)
+	text, args, err := q.bindArgs(p.text, p.args)
+	if err != nil {
+		q.setErr(err)
+		return p, false
+	}
+	p.text = text
+	q.addArgs(args)
+	q.fields = append(q.fields, p.fields...)
+	return p, true
+}
+
+// bindArgs binds the place holders of a part of the query to follow the args it already has, subqueries are put in place
+func (q *Query) bindArgs(text string, args []interface{}) (string, []interface{}, error) {
+	text, bound, subQueries, err := bindArgs(text, len(q.args)+1, args)
+	q.subQueries = append(q.subQueries, subQueries...)
+	return text, bound, err
+}
+
+// AndWhere is Where, it reads better when filters are added one by one
+func (q *Query) AndWhere(condition interface{}, args ...interface{}) *Query {
+	return q.Where(condition, args...)
+}
+
+// GroupBy groups the rows by fields, aggregates (Count, Sum, etc) are then computed for each group
+func (q *Query) GroupBy(fields ...string) *Query {
+	q.groupBy = append(q.groupBy, fields...)
+	q.fields = append(q.fields, fields...)
+	return q
+}
+
+// Having filters the groups, like Where does for rows. Repeated calls are combined with AND
+// aggregates are written in the condition: Having(`count(*) > ?`, 1)
+func (q *Query) Having(condition interface{}, args ...interface{}) *Query {
+	if p, ok := q.bindCondition(condition, args); ok {
+		q.having = append(q.having, p)
+	}
 	return q
 }
 
@@ -89,65 +283,214 @@ var (
 	}
 )
 
-// Order sorts the returning rows
-func (q *Query) Order(field string, orderType int) *Query {
-	q.query = fmt.Sprintf(orderTemplate, q.query, field, orderWords[orderType])
+// where NULLs go, they're last with Asc and first with Desc by default
+const (
+	NullsFirst = iota + 1
+	NullsLast
+)
+
+var (
+	nullsWords = map[int]string{
+		NullsFirst: `NULLS FIRST`,
+		NullsLast:  `NULLS LAST`,
+	}
+)
+
+// order is a field the query is sorted by
+type order struct {
+	field     string
+	orderType int
+	nulls     int // NullsFirst, NullsLast, or 0 for the default
+}
+
+// Order sorts the returning rows, repeated calls add fields to the same ORDER BY
+// field must be a registered column, or an alias / expression of the select, or the query fails when run
+// nulls is optional, NullsFirst or NullsLast
+func (q *Query) Order(field string, orderType int, nulls ...int) *Query {
+	o := order{field: field, orderType: orderType}
+	if len(nulls) > 0 {
+		o.nulls = nulls[0]
+	}
+	q.orders = append(q.orders, o)
 	return q
 }
 
 // Limit constrain the no of rows to return, and hence no of lookup
 func (q *Query) Limit(limit int) *Query {
-	q.query = fmt.Sprintf(limitTemplate, q.query, limit)
+	q.tail = fmt.Sprintf(limitTemplate, q.tail, limit)
+	q.limit = limit
 	return q
 }
 
 // Insert starts an insert query
+// maps and structs in args are stored as json
 // assume no of fields == no of args
-func Insert(table, fields string, args ...interface{}) *Query {
+func (m *Mapper) Insert(table, fields string, args ...interface{}) *Query {
 	argsStr := make([]string, 0, len(args))
 	for index := range args {
 		argsStr = append(argsStr, fmt.Sprintf(argTemplate, index+1))
 	}
-	return &Query{
+	fieldList := splitFields(fields)
+	tb := m.resolveTable(table)
+	q := &Query{
+		mapper:    m,
 		queryType: InsertQuery,
-		query:     fmt.Sprintf(insertTemplate, table, fields, strings.Join(argsStr, `, `)),
-		args:      args,
+		query:     fmt.Sprintf(insertTemplate, quoteIdentifier(tb.String()), strings.Join(quoteIdentifiers(fieldList), `, `), strings.Join(argsStr, `, `)),
+		tables:    []tableName{tb},
+		fields:    fieldList,
 	}
+	q.addArgs(args)
+	return q
 }
 
-// Update starts an update query
-// assume no of fields == no of args
-func Update(table, fields string, args ...interface{}) *Query {
-	parts := strings.Split(fields, placeHolder)
-	final := make([]string, 0, len(parts)*2)
-	for index := range args {
-		final = append(final, parts[index], fmt.Sprintf(argTemplate, index+1))
-	}
-	return &Query{
+// Insert starts an insert query on the default mapper
+func Insert(table, fields string, args ...interface{}) *Query {
+	return defaultMapper.Insert(table, fields, args...)
+}
+
+// Update starts an update query, fields is the SET clause ("name = ?, age = age + ?"), used as it is
+// maps and structs in args are stored as json
+// there must be 1 `?` per arg, `??` is a literal `?`
+func (m *Mapper) Update(table, fields string, args ...interface{}) *Query {
+	tb := m.resolveTable(table)
+	q := &Query{
+		mapper:    m,
 		queryType: UpdateQuery,
-		query:     fmt.Sprintf(updateTemplate, table, strings.Join(final, ``)),
-		args:      args,
+		tables:    []tableName{tb},
 	}
+	fields, args, err := q.bindArgs(fields, args)
+	q.setErr(err)
+	q.query = fmt.Sprintf(updateTemplate, quoteIdentifier(tb.String()), fields)
+	q.addArgs(args)
+	return q
+}
+
+// Update starts an update query on the default mapper
+func Update(table, fields string, args ...interface{}) *Query {
+	return defaultMapper.Update(table, fields, args...)
 }
 
 // Delete starts a delete query
 // be careful and add a where clause, or you will truncate the whole table
-func Delete(table string) *Query {
+func (m *Mapper) Delete(table string) *Query {
+	tb := m.resolveTable(table)
 	return &Query{
+		mapper:    m,
 		queryType: DeleteQuery,
-		query:     fmt.Sprintf(deleteTemplate, table),
+		query:     fmt.Sprintf(deleteTemplate, quoteIdentifier(tb.String())),
+		tables:    []tableName{tb},
 	}
 }
 
+// Delete starts a delete query on the default mapper
+func Delete(table string) *Query {
+	return defaultMapper.Delete(table)
+}
+
 // Truncate starts a truncate query
-func Truncate(tables ...string) *Query {
-	return &Query{
+func (m *Mapper) Truncate(tables ...string) *Query {
+	q := &Query{
+		mapper:    m,
 		queryType: TruncateQuery,
-		query:     fmt.Sprintf(truncateTemplate, strings.Join(tables, `, `)),
 	}
+	quoted := make([]string, 0, len(tables))
+	for _, table := range tables {
+		tb := m.resolveTable(table)
+		q.tables = append(q.tables, tb)
+		quoted = append(quoted, quoteIdentifier(tb.String()))
+	}
+	q.query = fmt.Sprintf(truncateTemplate, strings.Join(quoted, `, `))
+	return q
+}
+
+// Truncate starts a truncate query on the default mapper
+func Truncate(tables ...string) *Query {
+	return defaultMapper.Truncate(tables...)
+}
+
+// Returning makes an insert, bulk insert, update or delete query return columns of the rows it writes
+// The rows come back from Run as Records, typed from the registry like a Select
+// Fields are column names ("id") of the written table, or qualified ones ("t_users.id")
+func (q *Query) Returning(fields ...string) *Query {
+	switch q.queryType {
+	case InsertQuery, BulkInsertQuery, UpdateQuery, DeleteQuery:
+	default:
+		q.setErr(fmt.Errorf(returningErr))
+		return q
+	}
+	if len(fields) == 0 {
+		q.setErr(fmt.Errorf(noReturningErr))
+		return q
+	}
+
+	q.tail = fmt.Sprintf(returningTemplate, q.tail, strings.Join(quoteIdentifiers(fields), `, `))
+	q.selectFields = fields
+	return q
+}
+
+// sql gives the statement of the query: its WITH clause, its start (and ON CONFLICT), the where, group by, having & order by clauses,
+// then LIMIT, RETURNING, etc
+func (q *Query) sql() string {
+	statement := q.query
+	if q.conflict != nil {
+		statement = q.conflict.clause(statement)
+	}
+	if len(q.where) > 0 {
+		statement = fmt.Sprintf(whereTemplate, statement, And(q.where...).text)
+	}
+	if len(q.groupBy) > 0 {
+		statement = fmt.Sprintf(groupByTemplate, statement, strings.Join(quoteIdentifiers(q.groupBy), `, `))
+	}
+	if len(q.having) > 0 {
+		statement = fmt.Sprintf(havingTemplate, statement, And(q.having...).text)
+	}
+	if len(q.orders) > 0 {
+		fields := make([]string, 0, len(q.orders))
+		for _, o := range q.orders {
+			field := fmt.Sprintf(orderFieldTemplate, quoteIdentifier(o.field), orderWords[o.orderType])
+			if o.nulls != 0 {
+				field = fmt.Sprintf(orderFieldTemplate, field, nullsWords[o.nulls])
+			}
+			fields = append(fields, field)
+		}
+		statement = fmt.Sprintf(orderTemplate, statement, strings.Join(fields, `, `))
+	}
+	statement += q.tail
+	if q.with != nil {
+		statement = q.with.clause(statement)
+	}
+	return statement
 }
 
-// Run executes a query
+// returnsRows tells if the query gives rows back: a select, or a query with RETURNING
+func (q *Query) returnsRows() bool {
+	return q.queryType == SelectQuery || len(q.selectFields) > 0
+}
+
+// Run executes a query on the mapper that built it
 func (q *Query) Run() ([]Record, error) {
-	return Exec(q)
+	return q.getMapper().Exec(q)
+}
+
+// RunContext executes a query on the mapper that built it, stopped when ctx is done
+func (q *Query) RunContext(ctx context.Context) ([]Record, error) {
+	return q.getMapper().ExecContext(ctx, q)
+}
+
+// RunCount executes a query on the mapper that built it, and returns the no of rows it wrote
+func (q *Query) RunCount() (int64, error) {
+	return q.getMapper().ExecCount(q)
+}
+
+// RunCountContext is RunCount, stopped when ctx is done
+func (q *Query) RunCountContext(ctx context.Context) (int64, error) {
+	return q.getMapper().ExecCountContext(ctx, q)
+}
+
+// getMapper returns the mapper the query was built with, or the default mapper
+func (q *Query) getMapper() *Mapper {
+	if q.mapper == nil {
+		return defaultMapper
+	}
+	return q.mapper
 }
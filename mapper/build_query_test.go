@@ -1,7 +1,8 @@
 package mapper
 
 import (
-	. `gopkg.in/check.v1`
+	`github.com/lib/pq`
+	`gopkg.in/check.v1`
 )
 
 type BuilderTS struct {
@@ -9,7 +10,7 @@ type BuilderTS struct {
 }
 
 func init() {
-	Suite(&BuilderTS{})
+	check.Suite(&BuilderTS{})
 }
 
 // use a table here to minize copying code
@@ -23,77 +24,245 @@ var scenarios = []struct {
 	{
 		Select(`t_users.id`, `t_users.email`, `t_users.email_verified`).From(`t_users`),
 		SelectQuery,
-		`SELECT t_users.id, t_users.email, t_users.email_verified FROM t_users`,
+		`SELECT "t_users"."id", "t_users"."email", "t_users"."email_verified" FROM "t_users"`,
 		[]string{`t_users.id`, `t_users.email`, `t_users.email_verified`},
 		nil,
 	},
 	{
 		Select(`t_roles.name`, `t_roles.required_karma`).FromJoin(InnerJoin, `t_user_roles`, `t_roles`, `t_user_roles.role_id = t_roles.id`),
 		SelectQuery,
-		`SELECT t_roles.name, t_roles.required_karma FROM t_user_roles INNER JOIN t_roles ON t_user_roles.role_id = t_roles.id`,
+		`SELECT "t_roles"."name", "t_roles"."required_karma" FROM "t_user_roles" INNER JOIN "t_roles" ON t_user_roles.role_id = t_roles.id`,
 		[]string{`t_roles.name`, `t_roles.required_karma`},
 		nil,
 	},
+	{
+		Select(`t_users.email`, `t_roles.name`).From(`t_users`).Join(LeftJoin, `t_user_roles`, `t_user_roles.user_id = t_users.id`).Join(LeftJoin, `t_roles`, `t_roles.id = t_user_roles.role_id`),
+		SelectQuery,
+		`SELECT "t_users"."email", "t_roles"."name" FROM "t_users" LEFT JOIN "t_user_roles" ON t_user_roles.user_id = t_users.id LEFT JOIN "t_roles" ON t_roles.id = t_user_roles.role_id`,
+		[]string{`t_users.email`, `t_roles.name`},
+		nil,
+	},
+	{
+		Select(`t_users.id`, `t_roles.id`).FromJoin(CrossJoin, `t_users`, `t_roles`, ``).Join(FullJoin, `t_tags`, `t_tags.id = t_users.age`),
+		SelectQuery,
+		`SELECT "t_users"."id", "t_roles"."id" FROM "t_users" CROSS JOIN "t_roles" FULL JOIN "t_tags" ON t_tags.id = t_users.age`,
+		[]string{`t_users.id`, `t_roles.id`},
+		nil,
+	},
 	{
 		Select(`t_users.id`, `t_users.email`, `t_users.email_verified`).From(`t_users`).Where(`t_users.id = ? AND t_users.email_verified = ?`, `10u`, false),
 		SelectQuery,
-		`SELECT t_users.id, t_users.email, t_users.email_verified FROM t_users WHERE t_users.id = $1 AND t_users.email_verified = $2`,
+		`SELECT "t_users"."id", "t_users"."email", "t_users"."email_verified" FROM "t_users" WHERE t_users.id = $1 AND t_users.email_verified = $2`,
 		[]string{`t_users.id`, `t_users.email`, `t_users.email_verified`},
 		[]interface{}{`10u`, false},
 	},
 	{
 		Select(`t_users.id`, `t_users.email`, `t_users.email_verified`).From(`t_users`).Order(`t_users.id`, Asc).Limit(20),
 		SelectQuery,
-		`SELECT t_users.id, t_users.email, t_users.email_verified FROM t_users ORDER BY t_users.id ASC LIMIT 20`,
+		`SELECT "t_users"."id", "t_users"."email", "t_users"."email_verified" FROM "t_users" ORDER BY "t_users"."id" ASC LIMIT 20`,
 		[]string{`t_users.id`, `t_users.email`, `t_users.email_verified`},
 		nil,
 	},
+	{
+		Select(`t_events.id`).From(`t_events`).Where(`t_events.data->>'kind' = ? AND t_events.data @> ? AND t_events.meta IS NULL`, `login`, map[string]interface{}{`ok`: true}),
+		SelectQuery,
+		`SELECT "t_events"."id" FROM "t_events" WHERE t_events.data->>'kind' = $1 AND t_events.data @> $2 AND t_events.meta IS NULL`,
+		[]string{`t_events.id`},
+		[]interface{}{`login`, `{"ok":true}`},
+	},
+	{
+		Select(`t_tags.id`).From(`t_tags`).Where(`t_tags.id = ANY(?)`, []int64{1, 2}),
+		SelectQuery,
+		`SELECT "t_tags"."id" FROM "t_tags" WHERE t_tags.id = ANY($1)`,
+		[]string{`t_tags.id`},
+		[]interface{}{pq.Array([]int64{1, 2})},
+	},
 	{
 		Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100),
 		InsertQuery,
-		`INSERT INTO t_roles (id, name, required_karma) VALUES ($1, $2, $3)`,
+		`INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3)`,
 		nil,
 		[]interface{}{`1r`, `Code monkey`, 100},
 	},
 	{
 		Update(`t_roles`, `name = ?, required_karma = ?`, `Code kingkong`, 500),
 		UpdateQuery,
-		`UPDATE t_roles SET name = $1, required_karma = $2`,
+		`UPDATE "t_roles" SET name = $1, required_karma = $2`,
 		nil,
 		[]interface{}{`Code kingkong`, 500},
 	},
+	{
+		Insert(`t_events`, `id, data`, 1, struct {
+			Kind string `json:"kind"`
+		}{`login`}),
+		InsertQuery,
+		`INSERT INTO "t_events" ("id", "data") VALUES ($1, $2)`,
+		nil,
+		[]interface{}{1, `{"kind":"login"}`},
+	},
 	{
 		Update(`t_roles`, `name = ?, required_karma = ?`, `Bug eagle`, 1000).Where(`id = ?`, `1r`),
 		UpdateQuery,
-		`UPDATE t_roles SET name = $1, required_karma = $2 WHERE id = $3`,
+		`UPDATE "t_roles" SET name = $1, required_karma = $2 WHERE id = $3`,
 		nil,
 		[]interface{}{`Bug eagle`, 1000, `1r`},
 	},
 	{
 		Delete(`t_roles`),
 		DeleteQuery,
-		`DELETE FROM t_roles`,
+		`DELETE FROM "t_roles"`,
 		nil,
 		nil,
 	},
 	{
 		Delete(`t_roles`).Where(`id = ?`, `1r`),
 		DeleteQuery,
-		`DELETE FROM t_roles WHERE id = $1`,
+		`DELETE FROM "t_roles" WHERE id = $1`,
 		nil,
 		[]interface{}{`1r`},
 	},
+	{
+		Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100).Returning(`id`, `t_roles.required_karma`),
+		InsertQuery,
+		`INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3) RETURNING "id", "t_roles"."required_karma"`,
+		[]string{`id`, `t_roles.required_karma`},
+		[]interface{}{`1r`, `Code monkey`, 100},
+	},
+	{
+		Update(`t_roles`, `required_karma = ?`, 1000).Where(`id = ?`, `1r`).Returning(`name`),
+		UpdateQuery,
+		`UPDATE "t_roles" SET required_karma = $1 WHERE id = $2 RETURNING "name"`,
+		[]string{`name`},
+		[]interface{}{1000, `1r`},
+	},
+	{
+		Delete(`t_roles`).Where(`id = ?`, `1r`).Returning(`id`),
+		DeleteQuery,
+		`DELETE FROM "t_roles" WHERE id = $1 RETURNING "id"`,
+		[]string{`id`},
+		[]interface{}{`1r`},
+	},
 	{
 		Truncate(`t_roles`, `t_users`),
 		TruncateQuery,
-		`TRUNCATE t_roles, t_users`,
+		`TRUNCATE "t_roles", "t_users"`,
 		nil,
 		nil,
 	},
 }
 
-func (s *BuilderTS) TestQueryBuilder(c *C) {
+func (s *BuilderTS) TestQueryBuilder(c *check.C) {
 	for _, test := range scenarios {
 		testQuery(c, test.q, test.queryType, test.query, test.selectFields, test.args)
 	}
 }
+
+func (s *BuilderTS) TestOuterJoinTypes(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{
+		`public.t_users.id`:      StringType,
+		`public.t_roles.name`:    StringType,
+		`public.t_user_roles.id`: StringType,
+		`public.t_tags.names`:    StringArrayType,
+	})
+	types := func(q *Query) []int {
+		var found []int
+		for _, field := range []string{`t_users.id`, `t_roles.name`, `public.t_user_roles.id`, `t_tags.names`} {
+			colType, ok := m.columnType(q.tables, field)
+			c.Assert(ok, check.Equals, true)
+			found = append(found, colType)
+		}
+		return found
+	}
+
+	q := m.Select().FromJoin(InnerJoin, `t_users`, `t_user_roles`, `true`).Join(CrossJoin, `t_roles`, ``).Join(InnerJoin, `t_tags`, `true`)
+	c.Assert(types(q), check.DeepEquals, []int{StringType, StringType, StringType, StringArrayType})
+
+	q = m.Select().From(`t_users`).Join(LeftJoin, `t_user_roles`, `true`).Join(InnerJoin, `t_roles`, `true`).Join(LeftJoin, `t_tags`, `true`)
+	c.Assert(types(q), check.DeepEquals, []int{StringType, StringType, NullStringType, StringArrayType})
+
+	q = m.Select().From(`t_users`).Join(InnerJoin, `t_user_roles`, `true`).Join(RightJoin, `t_roles`, `true`).Join(InnerJoin, `t_tags`, `true`)
+	c.Assert(types(q), check.DeepEquals, []int{NullStringType, StringType, NullStringType, StringArrayType})
+
+	q = m.Select().From(`t_users`).Join(FullJoin, `t_roles`, `true`).Join(InnerJoin, `t_user_roles`, `true`)
+	c.Assert(types(q)[:3], check.DeepEquals, []int{NullStringType, NullStringType, StringType})
+}
+
+func (s *BuilderTS) TestOrder(c *check.C) {
+	testQuery(c,
+		SelectExpr(Column(`t_users.id`), Count(`*`).As(`total`)).From(`t_users`).GroupBy(`t_users.id`).
+			Order(`t_users.last_payment_at`, Desc, NullsLast).Order(`total`, Asc).Order(`t_users.email`, Asc, NullsFirst).Limit(5),
+		SelectQuery,
+		`SELECT "t_users"."id", count(*) AS "total" FROM "t_users" GROUP BY "t_users"."id" ORDER BY "t_users"."last_payment_at" DESC NULLS LAST, "total" ASC, "t_users"."email" ASC NULLS FIRST LIMIT 5`,
+		[]string{`t_users.id`, `total`},
+		nil,
+	)
+}
+
+func (s *BuilderTS) TestOrderFields(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{`public.t_users.id`: StringType, `public.t_users.email`: NullStringType})
+
+	valid := m.SelectExpr(Column(`t_users.id`), As(`t_users.email`, `mail`), Count(`*`).As(`n`)).From(`t_users`).
+		Order(`t_users.email`, Asc).Order(`id`, Asc).Order(`mail`, Desc).Order(`n`, Desc)
+	c.Assert(m.checkQuery(valid), check.IsNil)
+
+	for _, field := range []string{`t_users.age`, `t_roles.id`, `id; DROP TABLE t_users`, `random()`} {
+		err := m.checkQuery(m.Select(`t_users.id`).From(`t_users`).Order(field, Asc))
+		c.Assert(err, check.ErrorMatches, `cannot order by .*, it's not a registered column nor an alias of the query`)
+	}
+}
+
+func (s *BuilderTS) TestQuoteIdentifier(c *check.C) {
+	var tests = []struct{ name, quoted string }{
+		{`id`, `"id"`},
+		{`t_users.id`, `"t_users"."id"`},
+		{`t_audit.t_users.created_at`, `"t_audit"."t_users"."created_at"`},
+		{`*`, `*`},
+		{`count(*)`, `count(*)`},
+		{`id"; DROP TABLE t_users; --`, `id"; DROP TABLE t_users; --`},
+	}
+	for _, test := range tests {
+		c.Assert(quoteIdentifier(test.name), check.Equals, test.quoted)
+	}
+}
+
+func (s *BuilderTS) TestUnknownIdentifiers(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{`public.t_users.id`: StringType, `public.t_users.age`: Int64Type, `t_audit.t_users.action`: StringType})
+
+	var valid = []*Query{
+		m.SelectExpr(Column(`t_users.id`), Max(`age`, Int64Type).As(`oldest`)).From(`t_users`).Where(Eq(`t_users.age`, 1)).GroupBy(`t_users.id`),
+		m.Select(`t_users.action`).From(`t_audit.t_users`),
+		m.Insert(`t_users`, `id, age`, `1u`, 20).Returning(`id`),
+		m.Delete(`t_users`).Where(In(`id`, `1u`)),
+		m.Truncate(`t_users`),
+	}
+	for _, q := range valid {
+		c.Assert(m.checkQuery(q), check.IsNil)
+	}
+
+	var invalid = []struct {
+		q   *Query
+		err string
+	}{
+		{m.Select(`t_users.id`).From(`t_roles`), `table "t_roles" is not registered`},
+		{m.Select(`t_users.id`).From(`t_users`).Join(InnerJoin, `t_users; DROP TABLE t_users`, `true`), `table "t_users; DROP TABLE t_users" is not registered`},
+		{m.Select(`t_users.id`, `t_users.email`).From(`t_users`), `cannot scan "t_users.email", column is not registered`},
+		{m.Select(`t_users.id`).From(`t_users`).Where(Eq(`t_users.id = t_users.id OR true`, 1)), `field "t_users.id = t_users.id OR true" is not a registered column .*`},
+		{m.SelectExpr(Count(`t_users.email`)).From(`t_users`), `field "t_users.email" is not a registered column .*`},
+		{m.Select(`t_users.id`).From(`t_users`).GroupBy(`1; DROP TABLE t_users`), `field "1; DROP TABLE t_users" is not a registered column .*`},
+		{m.Insert(`t_users`, `id, email`, `1u`, `a@b.com`), `field "email" is not a registered column .*`},
+		{m.Truncate(`t_users`, `t_roles`), `table "t_roles" is not registered`},
+		{m.Update(`t_users`, `age = ?`, 1).Returning(`email`), `cannot scan "email", column is not registered`},
+	}
+	for _, test := range invalid {
+		c.Assert(m.checkQuery(test.q), check.ErrorMatches, test.err)
+	}
+}
+
+func (s *BuilderTS) TestReturningErrors(c *check.C) {
+	c.Assert(Select(`t_roles.id`).From(`t_roles`).Returning(`id`).err, check.ErrorMatches, `RETURNING can only be used with insert, bulk insert, update and delete queries`)
+	c.Assert(Delete(`t_roles`).Returning().err, check.ErrorMatches, `RETURNING needs at least 1 field`)
+	c.Assert(Truncate(`t_roles`).Returning(`id`).err, check.NotNil)
+}
@@ -0,0 +1,256 @@
+package mapper
+
+import (
+	`context`
+	`database/sql`
+	`fmt`
+	`github.com/exklamationmark/glog`
+	`github.com/lib/pq`
+	`strings`
+)
+
+const (
+	// postgres can't take more parameters than that in one statement
+	maxParams = 65535
+
+	bulkInsertTemplate = `INSERT INTO %s (%s) VALUES %s`
+	valuesTemplate     = `(%s)`
+	copyTemplate       = `COPY %s FROM STDIN`
+
+	noFieldsErr    = `bulk insert into "%s" needs at least 1 field`
+	rowLengthErr   = `row %d of bulk insert into "%s" has %d values, expected %d`
+	copyNotBulkErr = `COPY can only be used with bulk insert queries`
+	copyClausesErr = `COPY cannot be used with RETURNING or ON CONFLICT`
+	cannotCopyErr  = `copy into "%s" failed, err=%v`
+)
+
+// bulkInsert holds the rows of a BulkInsertQuery
+// Its statements are generated when it runs, since the rows may have to be split into batches
+type bulkInsert struct {
+	table  string
+	fields []string
+	rows   [][]interface{}
+	copy   bool // use COPY instead of INSERT statements
+}
+
+// statement is a sql statement with its arguments
+type statement struct {
+	query string
+	args  []interface{}
+}
+
+// BulkInsert starts an insert query of many rows. Each row must have 1 value per field
+// Rows are sent in multi-row INSERT statements, split in batches to stay under the 65535 parameters limit of postgres
+// RunCount (or ExecCount) returns the no of rows written. Batches run in a transaction: all the rows are written, or none.
+// Call Copy to use COPY instead, for very large loads
+func (m *Mapper) BulkInsert(table, fields string, rows [][]interface{}) *Query {
+	tb := m.resolveTable(table)
+	q := &Query{
+		mapper:    m,
+		queryType: BulkInsertQuery,
+		tables:    []tableName{tb},
+	}
+
+	fieldList := splitFields(fields)
+	q.fields = fieldList
+	if strings.TrimSpace(fields) == `` {
+		q.setErr(fmt.Errorf(noFieldsErr, table))
+		return q
+	}
+
+	converted := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		if len(row) != len(fieldList) {
+			q.setErr(fmt.Errorf(rowLengthErr, i, table, len(row), len(fieldList)))
+			return q
+		}
+		var err error
+		if converted[i], err = toSQLArgs(row); err != nil {
+			q.setErr(err)
+			return q
+		}
+	}
+
+	q.bulk = &bulkInsert{table: tb.String(), fields: fieldList, rows: converted}
+	return q
+}
+
+// BulkInsert starts an insert query of many rows on the default mapper
+func BulkInsert(table, fields string, rows [][]interface{}) *Query {
+	return defaultMapper.BulkInsert(table, fields, rows)
+}
+
+// Copy makes a bulk insert use COPY (through pq.CopyIn), which is much faster for large loads
+// It runs in its own transaction (unless run in a Tx), and can't be used with RETURNING or ON CONFLICT
+func (q *Query) Copy() *Query {
+	if q.queryType != BulkInsertQuery {
+		q.setErr(fmt.Errorf(copyNotBulkErr))
+		return q
+	}
+	if q.bulk != nil {
+		q.bulk.copy = true
+	}
+	return q
+}
+
+// statements splits the rows into INSERT statements, each having at most maxParams parameters
+// clauses coming after VALUES (RETURNING, etc) are added to every statement
+func (b *bulkInsert) statements(clauses string) []statement {
+	batchSize := maxParams / len(b.fields)
+	statements := make([]statement, 0, len(b.rows)/batchSize+1)
+	for start := 0; start < len(b.rows); start += batchSize {
+		end := start + batchSize
+		if end > len(b.rows) {
+			end = len(b.rows)
+		}
+
+		values := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*len(b.fields))
+		for _, row := range b.rows[start:end] {
+			placeholders := make([]string, len(row))
+			for i := range row {
+				placeholders[i] = fmt.Sprintf(argTemplate, len(args)+i+1)
+			}
+			values = append(values, fmt.Sprintf(valuesTemplate, strings.Join(placeholders, `, `)))
+			args = append(args, row...)
+		}
+
+		query := fmt.Sprintf(bulkInsertTemplate, quoteIdentifier(b.table), strings.Join(quoteIdentifiers(b.fields), `, `), strings.Join(values, `, `)) + clauses
+		statements = append(statements, statement{query: query, args: args})
+	}
+	return statements
+}
+
+// execBulk runs a bulk insert, batch by batch. Records are only returned with RETURNING
+func (m *Mapper) execBulk(ctx context.Context, ex executor, query *Query) ([]Record, error) {
+	if query.bulk.copy {
+		_, err := m.copyIn(ctx, ex, query)
+		return nil, err
+	}
+
+	var results []Record
+	statements := query.bulk.statements(query.sql())
+	err := m.inTx(ctx, ex, len(statements) > 1, func(ex executor) error {
+		for _, stmt := range statements {
+			records, err := m.execStatement(ctx, ex, query, stmt.query, stmt.args)
+			if err != nil {
+				return err
+			}
+			results = append(results, records...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// execBulkCount runs a bulk insert, batch by batch, and returns the total no of rows written
+func (m *Mapper) execBulkCount(ctx context.Context, ex executor, query *Query) (int64, error) {
+	if query.bulk.copy {
+		return m.copyIn(ctx, ex, query)
+	}
+
+	var total int64
+	statements := query.bulk.statements(query.sql())
+	err := m.inTx(ctx, ex, len(statements) > 1, func(ex executor) error {
+		for _, stmt := range statements {
+			count, err := m.execStatementCount(ctx, ex, query, stmt.query, stmt.args)
+			if err != nil {
+				return err
+			}
+			total += count
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// inTx runs fn with the executor when it's a transaction, or when needTx is false. Otherwise fn is run
+// in a new transaction, committed if fn succeeds: batches written before a failing one are rolled back
+func (m *Mapper) inTx(ctx context.Context, ex executor, needTx bool, fn func(ex executor) error) error {
+	if _, ok := ex.(*sql.Tx); ok || !needTx {
+		return fn(ex)
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf(cannotBeginErr, err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyIn loads the rows of a bulk insert with COPY. COPY needs a transaction:
+// the executor's when it's one, otherwise a new one
+func (m *Mapper) copyIn(ctx context.Context, ex executor, query *Query) (int64, error) {
+	b := query.bulk
+	if query.sql() != `` {
+		return 0, fmt.Errorf(copyClausesErr)
+	}
+
+	if tx, ok := ex.(*sql.Tx); ok {
+		count, err := copyRows(ctx, tx, parseTable(b.table), b.fields, b.rows)
+		if err != nil {
+			glog.Error(fmt.Sprintf(cannotCopyErr, b.table, err))
+			return 0, checkCanceled(ctx, copyStatement(b.table), fmt.Errorf(cannotCopyErr, b.table, err))
+		}
+		return count, nil
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf(cannotCopyErr, b.table, err)
+	}
+
+	count, err := copyRows(ctx, tx, parseTable(b.table), b.fields, b.rows)
+	if err != nil {
+		glog.Error(fmt.Sprintf(cannotCopyErr, b.table, err))
+		tx.Rollback()
+		return 0, checkCanceled(ctx, copyStatement(b.table), fmt.Errorf(cannotCopyErr, b.table, err))
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf(cannotCopyErr, b.table, err)
+	}
+	return count, nil
+}
+
+// copyStatement describes a COPY for errors
+func copyStatement(table string) string {
+	return fmt.Sprintf(copyTemplate, table)
+}
+
+// copyRows sends rows through a COPY statement, and returns how many were sent
+func copyRows(ctx context.Context, tx *sql.Tx, tb tableName, fields []string, rows [][]interface{}) (int64, error) {
+	copyQuery := pq.CopyIn(tb.name, fields...)
+	if tb.schema != `` {
+		copyQuery = pq.CopyInSchema(tb.schema, tb.name, fields...)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, copyQuery)
+	if err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return 0, err
+		}
+	}
+	// an Exec without args flushes the data
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	if err := stmt.Close(); err != nil {
+		return 0, err
+	}
+	return int64(len(rows)), nil
+}
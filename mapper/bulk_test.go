@@ -0,0 +1,50 @@
+package mapper
+
+import (
+	`gopkg.in/check.v1`
+)
+
+type BulkTS struct{}
+
+func init() {
+	check.Suite(&BulkTS{})
+}
+
+func (s *BulkTS) TestStatements(c *check.C) {
+	q := BulkInsert(`t_roles`, `id, name, required_karma`, [][]interface{}{
+		{`1r`, `Code monkey`, 100},
+		{`2r`, `Bug eagle`, 1000},
+	}).Returning(`id`)
+	c.Assert(q.err, check.IsNil)
+	c.Assert(q.queryType, check.Equals, BulkInsertQuery)
+
+	statements := q.bulk.statements(q.sql())
+	c.Assert(statements, check.DeepEquals, []statement{{
+		query: `INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3), ($4, $5, $6) RETURNING "id"`,
+		args:  []interface{}{`1r`, `Code monkey`, 100, `2r`, `Bug eagle`, 1000},
+	}})
+}
+
+func (s *BulkTS) TestBatches(c *check.C) {
+	rows := make([][]interface{}, maxParams/3+1)
+	for i := range rows {
+		rows[i] = []interface{}{i, i, i}
+	}
+
+	statements := BulkInsert(`t_roles`, `id, name, required_karma`, rows).bulk.statements(``)
+	c.Assert(len(statements), check.Equals, 2)
+	c.Assert(len(statements[0].args), check.Equals, maxParams)
+	c.Assert(statements[1], check.DeepEquals, statement{
+		query: `INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3)`,
+		args:  []interface{}{maxParams / 3, maxParams / 3, maxParams / 3},
+	})
+}
+
+func (s *BulkTS) TestErrors(c *check.C) {
+	var tests = []testEntry{
+		{BulkInsert(`t_roles`, ` `, nil).err, check.ErrorMatches, `bulk insert into "t_roles" needs at least 1 field`},
+		{BulkInsert(`t_roles`, `id, name`, [][]interface{}{{`1r`, `a`}, {`2r`}}).err, check.ErrorMatches, `row 1 of bulk insert into "t_roles" has 1 values, expected 2`},
+		{Insert(`t_roles`, `id`, `1r`).Copy().err, check.ErrorMatches, `COPY can only be used with bulk insert queries`},
+	}
+	tableCheck(c, tests)
+}
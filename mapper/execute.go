@@ -1,7 +1,9 @@
 package mapper
 
 import (
+	`context`
 	`database/sql`
+	`encoding/json`
 	`fmt`
 	`github.com/exklamationmark/glog`
 	`github.com/lib/pq`
@@ -10,93 +12,401 @@ import (
 
 const (
 	cannotRunQueryErr = `query "%s" failed to run, err=%v`
+	unknownColumnErr  = `cannot scan "%s", column is not registered`
+	jsonDecodeErr     = `cannot decode json in "%s", err=%v`
 	rowScanErr        = `scanning row failed, rows=%v, err=%v`
+	canceledErr       = `query "%s" was stopped, err=%v`
+	unknownOrderErr   = `cannot order by %s, it's not a registered column nor an alias of the query`
+	unknownTableErr   = `table "%s" is not registered`
+	unknownFieldErr   = `field "%s" is not a registered column nor an alias of the query`
 
 	initResultsCount = 10
 )
 
-// Record is a map of columns / values returned by a query (SelectQuery)
+// Record is a map of columns / values returned by a query (SelectQuery, or with RETURNING)
 type Record map[string]interface{}
 
+// executor runs sql statements, it's either the db or a transaction
+type executor interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// CanceledError is returned when a query is stopped by its context,
+// because it was canceled or its deadline (or Configuration.StatementTimeout) passed
+type CanceledError struct {
+	Query string
+	Err   error // context.Canceled or context.DeadlineExceeded
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf(canceledErr, e.Query, e.Err)
+}
+
+// Unwrap gives the context error, so errors.Is(err, context.DeadlineExceeded) works
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// checkCanceled turns an error into a *CanceledError when the context is done
+// the driver's own error (e.g. pq's "canceling statement due to user request") is not very telling
+func checkCanceled(ctx context.Context, statement string, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	return &CanceledError{Query: statement, Err: ctx.Err()}
+}
+
+// withTimeout applies Configuration.StatementTimeout to a context
+// an earlier deadline already on the context is kept
+func (m *Mapper) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.config.StatementTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, m.config.StatementTimeout)
+}
+
 // Exec run a query and extract results as a map
+func (m *Mapper) Exec(query *Query) ([]Record, error) {
+	return m.ExecContext(context.Background(), query)
+}
+
+// ExecContext run a query and extract results as a map. The query is stopped when ctx is done,
+// and a *CanceledError returned
+func (m *Mapper) ExecContext(ctx context.Context, query *Query) ([]Record, error) {
+	return m.exec(ctx, m.db, query)
+}
+
+// exec runs a query with an executor and extract results as a map
+func (m *Mapper) exec(ctx context.Context, ex executor, query *Query) ([]Record, error) {
+	if err := m.checkQuery(query); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if query.queryType == BulkInsertQuery {
+		return m.execBulk(ctx, ex, query)
+	}
+	return m.execStatement(ctx, ex, query, query.sql(), query.args)
+}
+
+// checkQuery returns the error found while building the query, or in the parts of it that must be registered.
+// Tables and fields given to the builders are often chosen by users (sort params, filters), and are put in the sql:
+// they must be registered, or declared in the query (aliases, expressions)
+func (m *Mapper) checkQuery(query *Query) error {
+	if query.err != nil {
+		return query.err
+	}
+	if query.conflict != nil && !query.conflict.doNothing && len(query.conflict.updates) == 0 {
+		return fmt.Errorf(conflictNoActionErr)
+	}
+	// the queries put in this one first, the fields of a WITH query are resolved through it
+	for _, sub := range query.subQueries {
+		if err := m.checkQuery(sub); err != nil {
+			return err
+		}
+	}
+	for _, tb := range query.tables {
+		if query.with != nil && tb.schema == `` && query.with.query(tb.name) != nil {
+			continue
+		}
+		if !m.tableRegistered(tb) {
+			return fmt.Errorf(unknownTableErr, tb)
+		}
+	}
+	for _, field := range query.selectFields {
+		if !m.knownField(query, field) {
+			return fmt.Errorf(unknownColumnErr, field)
+		}
+	}
+	for _, field := range query.fields {
+		if !m.knownField(query, field) {
+			return fmt.Errorf(unknownFieldErr, field)
+		}
+	}
+	for _, o := range query.orders {
+		if !m.knownField(query, o.field) {
+			return fmt.Errorf(unknownOrderErr, o.field)
+		}
+	}
+	return nil
+}
+
+// knownField tells if a field is a registered column of the query's tables, or an alias / expression of its select
+func (m *Mapper) knownField(query *Query, field string) bool {
+	_, ok := m.fieldType(query, field)
+	return ok
+}
+
+// fieldType gives the type of a field of a query: a declared expression, an alias, a column of a WITH query,
+// or a registered column
+func (m *Mapper) fieldType(query *Query, field string) (int, bool) {
+	if colType, ok := query.exprTypes[field]; ok {
+		return colType, true
+	}
+	if column, ok := query.aliases[field]; ok {
+		field = column
+	}
+	if query.with != nil {
+		if colType, ok := m.cteColumnType(query, field); ok {
+			return colType, true
+		}
+	}
+	return m.columnType(query.tables, field)
+}
+
+// Exec run a query on the default mapper and extract results as a map
 func Exec(query *Query) ([]Record, error) {
-	rows, err := dbconnection.Query(query.query, query.args...)
+	return defaultMapper.Exec(query)
+}
+
+// ExecContext run a query on the default mapper and extract results as a map
+func ExecContext(ctx context.Context, query *Query) ([]Record, error) {
+	return defaultMapper.ExecContext(ctx, query)
+}
+
+// ExecCount runs a query and returns the no of rows it wrote (or selected), instead of the rows
+// For a bulk insert, that's the total of all batches
+func (m *Mapper) ExecCount(query *Query) (int64, error) {
+	return m.ExecCountContext(context.Background(), query)
+}
+
+// ExecCountContext is ExecCount, stopped when ctx is done
+func (m *Mapper) ExecCountContext(ctx context.Context, query *Query) (int64, error) {
+	return m.execCount(ctx, m.db, query)
+}
+
+// execCount runs a query with an executor and returns the no of rows it wrote
+func (m *Mapper) execCount(ctx context.Context, ex executor, query *Query) (int64, error) {
+	if err := m.checkQuery(query); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+	if query.queryType == BulkInsertQuery {
+		return m.execBulkCount(ctx, ex, query)
+	}
+	return m.execStatementCount(ctx, ex, query, query.sql(), query.args)
+}
+
+// ExecCount runs a query on the default mapper and returns the no of rows it wrote
+func ExecCount(query *Query) (int64, error) {
+	return defaultMapper.ExecCount(query)
+}
+
+// ExecCountContext runs a query on the default mapper and returns the no of rows it wrote
+func ExecCountContext(ctx context.Context, query *Query) (int64, error) {
+	return defaultMapper.ExecCountContext(ctx, query)
+}
+
+// execStatementCount runs one sql statement and returns the no of rows affected
+func (m *Mapper) execStatementCount(ctx context.Context, ex executor, query *Query, statement string, args []interface{}) (int64, error) {
+	stmt, done, err := m.prepared(ctx, ex, query, statement)
+	if err != nil {
+		glog.Error(fmt.Sprintf(cannotRunQueryErr, statement, err))
+		return 0, checkCanceled(ctx, statement, err)
+	}
+	defer done()
+
+	var result sql.Result
+	if stmt != nil {
+		result, err = stmt.ExecContext(ctx, args...)
+	} else {
+		result, err = ex.ExecContext(ctx, statement, args...)
+	}
+	if err != nil {
+		glog.Error(fmt.Sprintf(cannotRunQueryErr, statement, err))
+		return 0, checkCanceled(ctx, statement, err)
+	}
+	return result.RowsAffected()
+}
+
+// execStatement runs one sql statement of a query and extract results as a map
+func (m *Mapper) execStatement(ctx context.Context, ex executor, query *Query, statement string, args []interface{}) ([]Record, error) {
+	rows, done, err := m.queryRows(ctx, ex, query, statement, args)
 	if err != nil {
-		glog.Error(fmt.Printf(cannotRunQueryErr, query.query, err))
 		return nil, err
 	}
+	defer done()
 	defer rows.Close()
 
-	// assuming other queries doesn't return values, only Select does
-	if query.queryType != SelectQuery {
+	// other queries doesn't return values, only Select and those with RETURNING does
+	if !query.returnsRows() {
 		return nil, nil
 	}
 
 	results := make([]Record, 0, initResultsCount)
-	placeholders := createPlaceholders(query.selectFields)
+	placeholders, colTypes, err := m.createPlaceholders(query)
+	if err != nil {
+		return nil, err
+	}
 
 	for rows.Next() {
-
-		if err := rows.Scan(placeholders...); err != nil {
-			glog.Error(fmt.Sprintf(rowScanErr, rows, err))
+		record, err := m.scanRecord(query, rows, placeholders, colTypes)
+		if err != nil {
 			return nil, err
 		}
-
-		// placeholders should contain data in order of fields in selectFields
-		record := make(Record, len(query.selectFields))
-		for i := 0; i < len(query.selectFields); i++ {
-			colType := columns[query.selectFields[i]]
-			switch colType {
-			case stringType:
-				record[query.selectFields[i]] = *(placeholders[i].(*string))
-			case nullStringType:
-				record[query.selectFields[i]] = *(placeholders[i].(*sql.NullString))
-			case int64Type:
-				record[query.selectFields[i]] = *(placeholders[i].(*int64))
-			case boolType:
-				record[query.selectFields[i]] = *(placeholders[i].(*bool))
-			case nullBoolType:
-				record[query.selectFields[i]] = *(placeholders[i].(*sql.NullBool))
-			case nullInt64Type:
-				record[query.selectFields[i]] = *(placeholders[i].(*sql.NullInt64))
-			case nullTimeType:
-				record[query.selectFields[i]] = *(placeholders[i].(*pq.NullTime))
-			case timeType:
-				record[query.selectFields[i]] = *(placeholders[i].(*time.Time))
-			default:
-				return nil, fmt.Errorf(`unknown column type`)
-			}
-		}
 		results = append(results, record)
 	}
+	// rows stop early when the context is done
+	if err := rows.Err(); err != nil {
+		return nil, checkCanceled(ctx, statement, err)
+	}
 
 	return results, nil
 }
 
-// createPlaceholder generate a slice of pointers to hold data in select query
-func createPlaceholders(fields []string) []interface{} {
+// queryRows runs one sql statement giving rows, prepared through the statement cache when it's on
+// done must be called once the rows are closed
+func (m *Mapper) queryRows(ctx context.Context, ex executor, query *Query, statement string, args []interface{}) (*sql.Rows, func(), error) {
+	stmt, done, err := m.prepared(ctx, ex, query, statement)
+	if err != nil {
+		glog.Error(fmt.Sprintf(cannotRunQueryErr, statement, err))
+		return nil, nil, checkCanceled(ctx, statement, err)
+	}
+
+	var rows *sql.Rows
+	if stmt != nil {
+		rows, err = stmt.QueryContext(ctx, args...)
+	} else {
+		rows, err = ex.QueryContext(ctx, statement, args...)
+	}
+	if err != nil {
+		done()
+		glog.Error(fmt.Sprintf(cannotRunQueryErr, statement, err))
+		return nil, nil, checkCanceled(ctx, statement, err)
+	}
+	return rows, done, nil
+}
+
+// scanRecord scans the current row into placeholders (from createPlaceholders), and makes a Record of it
+func (m *Mapper) scanRecord(query *Query, rows *sql.Rows, placeholders []interface{}, colTypes []int) (Record, error) {
+	if err := rows.Scan(placeholders...); err != nil {
+		glog.Error(fmt.Sprintf(rowScanErr, rows, err))
+		return nil, err
+	}
+
+	// placeholders should contain data in order of fields in selectFields
+	record := make(Record, len(query.selectFields))
+	for i := 0; i < len(query.selectFields); i++ {
+		switch colTypes[i] {
+		case StringType:
+			record[query.selectFields[i]] = *(placeholders[i].(*string))
+		case NullStringType:
+			record[query.selectFields[i]] = *(placeholders[i].(*sql.NullString))
+		case Int64Type:
+			record[query.selectFields[i]] = *(placeholders[i].(*int64))
+		case BoolType:
+			record[query.selectFields[i]] = *(placeholders[i].(*bool))
+		case NullBoolType:
+			record[query.selectFields[i]] = *(placeholders[i].(*sql.NullBool))
+		case NullInt64Type:
+			record[query.selectFields[i]] = *(placeholders[i].(*sql.NullInt64))
+		case NullTimeType:
+			record[query.selectFields[i]] = *(placeholders[i].(*pq.NullTime))
+		case TimeType:
+			record[query.selectFields[i]] = *(placeholders[i].(*time.Time))
+		case Float64Type:
+			record[query.selectFields[i]] = *(placeholders[i].(*float64))
+		case NullFloat64Type:
+			record[query.selectFields[i]] = *(placeholders[i].(*sql.NullFloat64))
+		case NumericType:
+			record[query.selectFields[i]] = *(placeholders[i].(*string))
+		case NullNumericType:
+			record[query.selectFields[i]] = *(placeholders[i].(*sql.NullString))
+		case BytesType, NullBytesType:
+			record[query.selectFields[i]] = *(placeholders[i].(*[]byte))
+		case JSONType, NullJSONType:
+			value, err := m.decodeJSON(*(placeholders[i].(*[]byte)))
+			if err != nil {
+				return nil, fmt.Errorf(jsonDecodeErr, query.selectFields[i], err)
+			}
+			record[query.selectFields[i]] = value
+		case StringArrayType:
+			record[query.selectFields[i]] = []string(*(placeholders[i].(*pq.StringArray)))
+		case Int64ArrayType:
+			record[query.selectFields[i]] = []int64(*(placeholders[i].(*pq.Int64Array)))
+		case Float64ArrayType:
+			record[query.selectFields[i]] = []float64(*(placeholders[i].(*pq.Float64Array)))
+		case BoolArrayType:
+			record[query.selectFields[i]] = []bool(*(placeholders[i].(*pq.BoolArray)))
+		default:
+			return nil, fmt.Errorf(`unknown column type`)
+		}
+	}
+	return record, nil
+}
+
+// createPlaceholder generate a slice of pointers to hold data in select query, along with the column types
+func (m *Mapper) createPlaceholders(query *Query) ([]interface{}, []int, error) {
+	fields := query.selectFields
 	placeholders := make([]interface{}, len(fields))
+	colTypes := make([]int, len(fields))
 	for i := 0; i < len(fields); i++ {
 		field := fields[i]
-		fieldType := columns[field]
+		fieldType, ok := m.fieldType(query, field)
+		if !ok {
+			return nil, nil, fmt.Errorf(unknownColumnErr, field)
+		}
+		colTypes[i] = fieldType
 		switch fieldType {
-		case stringType:
+		case StringType:
 			placeholders[i] = new(string)
-		case nullStringType:
+		case NullStringType:
 			placeholders[i] = new(sql.NullString)
-		case int64Type:
+		case Int64Type:
 			placeholders[i] = new(int64)
-		case boolType:
+		case BoolType:
 			placeholders[i] = new(bool)
-		case nullBoolType:
+		case NullBoolType:
 			placeholders[i] = new(sql.NullBool)
-		case nullInt64Type:
+		case NullInt64Type:
 			placeholders[i] = new(sql.NullInt64)
-		case nullTimeType:
+		case NullTimeType:
 			placeholders[i] = new(pq.NullTime)
-		case timeType:
+		case TimeType:
 			placeholders[i] = new(time.Time)
+		case Float64Type:
+			placeholders[i] = new(float64)
+		case NullFloat64Type:
+			placeholders[i] = new(sql.NullFloat64)
+		case NumericType:
+			placeholders[i] = new(string)
+		case NullNumericType:
+			placeholders[i] = new(sql.NullString)
+		case BytesType, NullBytesType, JSONType, NullJSONType:
+			// the driver leaves a nil slice for NULL
+			placeholders[i] = new([]byte)
+		case StringArrayType:
+			placeholders[i] = new(pq.StringArray)
+		case Int64ArrayType:
+			placeholders[i] = new(pq.Int64Array)
+		case Float64ArrayType:
+			placeholders[i] = new(pq.Float64Array)
+		case BoolArrayType:
+			placeholders[i] = new(pq.BoolArray)
 		}
 	}
-	return placeholders
+	return placeholders, colTypes, nil
+}
+
+// decodeJSON turns the content of a json/jsonb column into a json.RawMessage,
+// or into Go values (objects become map[string]interface{}) when Configuration.DecodeJSON is set
+// NULL gives a nil json.RawMessage, or nil
+func (m *Mapper) decodeJSON(raw []byte) (interface{}, error) {
+	if !m.config.DecodeJSON {
+		return json.RawMessage(raw), nil
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
 }
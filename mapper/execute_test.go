@@ -1,11 +1,16 @@
 package mapper
 
 import (
+	`context`
 	`database/sql`
+	`encoding/json`
+	`errors`
+	`fmt`
 	`github.com/exklamationmark/glog`
 	`github.com/lib/pq`
 	. `github.com/viki-org/gomods/sqlcheckers`
-	. `gopkg.in/check.v1`
+	`gopkg.in/check.v1`
+	`time`
 )
 
 type SelectExecTS struct {
@@ -28,6 +33,20 @@ type DeleteExecTS struct {
 	query *Query
 }
 
+type TypesExecTS struct{}
+
+type JSONExecTS struct{}
+
+type ArrayExecTS struct{}
+
+type ReturningExecTS struct{}
+
+type JoinExecTS struct{}
+
+type ContextTS struct{}
+
+type ContextExecTS struct{}
+
 func init() {
 	conn, err := sql.Open(`postgres`, `host=localhost port=5432 sslmode=disable dbname=users_test user=postgres password=password`)
 	if err != nil {
@@ -35,11 +54,18 @@ func init() {
 	}
 	Connect(conn)
 
-	Suite(&SelectExecTS{})
-	Suite(&InsertExecTS{})
-	Suite(&BulkInsertExecTS{})
-	Suite(&UpdateExecTS{})
-	Suite(&DeleteExecTS{})
+	check.Suite(&SelectExecTS{})
+	check.Suite(&InsertExecTS{})
+	check.Suite(&BulkInsertExecTS{})
+	check.Suite(&UpdateExecTS{})
+	check.Suite(&DeleteExecTS{})
+	check.Suite(&TypesExecTS{})
+	check.Suite(&JSONExecTS{})
+	check.Suite(&ArrayExecTS{})
+	check.Suite(&ReturningExecTS{})
+	check.Suite(&JoinExecTS{})
+	check.Suite(&ContextTS{})
+	check.Suite(&ContextExecTS{})
 }
 
 var (
@@ -56,7 +82,7 @@ var (
 	}
 )
 
-func (s *SelectExecTS) SetUpTest(c *C) {
+func (s *SelectExecTS) SetUpTest(c *check.C) {
 	createTestTables()
 	Register(`t_users`)
 	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `1u`, `user@test.com`, 20, false, false, 0, nil, testTime)
@@ -64,17 +90,17 @@ func (s *SelectExecTS) SetUpTest(c *C) {
 	s.query = sampleSelect
 }
 
-func (s *SelectExecTS) TestSelectExec(c *C) {
+func (s *SelectExecTS) TestSelectExec(c *check.C) {
 	data, err := Exec(s.query)
 
-	c.Assert(err, IsNil)
-	c.Assert(len(data), Equals, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
 
 	var tests = []testEntry{
-		{`t_users.id`, Equals, `1u`},
+		{`t_users.id`, check.Equals, `1u`},
 		{`t_users.email`, SQLEquals, sql.NullString{Valid: true, String: `user@test.com`}},
-		{`t_users.age`, Equals, int64(20)},
-		{`t_users.active`, Equals, false},
+		{`t_users.age`, check.Equals, int64(20)},
+		{`t_users.active`, check.Equals, false},
 		{`t_users.email_verified`, SQLEquals, sql.NullBool{Valid: true, Bool: false}},
 		{`t_users.no_of_licenses`, SQLEquals, sql.NullInt64{Valid: true, Int64: int64(0)}},
 		{`t_users.created_at`, SQLEquals, testTime},
@@ -83,25 +109,50 @@ func (s *SelectExecTS) TestSelectExec(c *C) {
 	recordCheck(data[0], tests, c)
 }
 
-func (s *InsertExecTS) SetUpTest(c *C) {
+func (s *SelectExecTS) TestOrderExec(c *check.C) {
+	exec(sampleInsert.query, sampleInsert.args...)
+	exec(`UPDATE t_users SET last_payment_at = $1 WHERE id = $2`, testTime, `2u`)
+
+	data, err := Select(`t_users.id`).From(`t_users`).Order(`t_users.last_payment_at`, Desc, NullsLast).Order(`t_users.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(data[0][`t_users.id`], check.Equals, `2u`)
+	c.Assert(data[1][`t_users.id`], check.Equals, `1u`)
+
+	_, err = Select(`t_users.id`).From(`t_users`).Order(`(SELECT 1)`, Asc).Run()
+	c.Assert(err, check.ErrorMatches, `cannot order by .*`)
+}
+
+func (s *SelectExecTS) TestUnknownIdentifiers(c *check.C) {
+	_, err := Select(`t_users.id`).From(`t_users`).Where(Eq(`t_users.id = t_users.id OR ''`, ``)).Run()
+	c.Assert(err, check.ErrorMatches, `field .* is not a registered column nor an alias of the query`)
+
+	_, err = Delete(`t_users; DROP TABLE t_roles`).RunCount()
+	c.Assert(err, check.ErrorMatches, `table .* is not registered`)
+
+	data, err := Exec(s.query)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+}
+
+func (s *InsertExecTS) SetUpTest(c *check.C) {
 	createTestTables()
 	Register(`t_users`)
 
 	s.query = sampleInsert
 }
 
-func (s *InsertExecTS) TestInsertExec(c *C) {
+func (s *InsertExecTS) TestInsertExec(c *check.C) {
 	data, err := Exec(s.query)
 
-	c.Assert(err, IsNil)
-	c.Assert(data, IsNil)
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.IsNil)
 
 	data, err = Exec(sampleSelect)
 	var tests = []testEntry{
-		{`t_users.id`, Equals, `2u`},
+		{`t_users.id`, check.Equals, `2u`},
 		{`t_users.email`, SQLEquals, sql.NullString{Valid: true, String: `darth@vader.com`}},
-		{`t_users.age`, Equals, int64(40)},
-		{`t_users.active`, Equals, true},
+		{`t_users.age`, check.Equals, int64(40)},
+		{`t_users.active`, check.Equals, true},
 		{`t_users.email_verified`, SQLEquals, sql.NullBool{Valid: true, Bool: true}},
 		{`t_users.no_of_licenses`, SQLEquals, sql.NullInt64{Valid: true, Int64: int64(0)}},
 		{`t_users.created_at`, SQLEquals, testTime},
@@ -110,11 +161,69 @@ func (s *InsertExecTS) TestInsertExec(c *C) {
 	recordCheck(data[0], tests, c)
 }
 
-func (s *UpdateExecTS) SetUpTest(c *C) {
+func (s *BulkInsertExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_roles`), check.IsNil)
+
+	s.query = BulkInsert(`t_roles`, `id, name, required_karma`, [][]interface{}{
+		{`1r`, `Code monkey`, 100},
+		{`2r`, `Bug eagle`, 1000},
+		{`3r`, `Code kingkong`, 500},
+	})
+}
+
+func (s *BulkInsertExecTS) TestBulkInsert(c *check.C) {
+	count, err := s.query.RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(3))
+
+	data, err := Select(`t_roles.id`, `t_roles.required_karma`).From(`t_roles`).Order(`t_roles.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 3)
+	c.Assert(data[2][`t_roles.id`], check.Equals, `3r`)
+	c.Assert(data[2][`t_roles.required_karma`], check.Equals, int64(500))
+}
+
+func (s *BulkInsertExecTS) TestBulkInsertAtomic(c *check.C) {
+	// the last row, alone in the second batch, has the id of the first one
+	rows := make([][]interface{}, maxParams/3+1)
+	for i := range rows {
+		rows[i] = []interface{}{fmt.Sprintf(`%dr`, i%(maxParams/3)), `Code monkey`, i}
+	}
+	count, err := BulkInsert(`t_roles`, `id, name, required_karma`, rows).RunCount()
+	c.Assert(err, check.ErrorMatches, `.*duplicate key.*`)
+	c.Assert(count, check.Equals, int64(0))
+
+	count, err = Select(`t_roles.id`).From(`t_roles`).RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(0))
+}
+
+func (s *BulkInsertExecTS) TestBulkInsertReturning(c *check.C) {
+	data, err := s.query.Returning(`id`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 3)
+	c.Assert(data[0][`id`], check.Equals, `1r`)
+}
+
+func (s *BulkInsertExecTS) TestBulkInsertCopy(c *check.C) {
+	count, err := s.query.Copy().RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(3))
+
+	count, err = Select(`t_roles.id`).From(`t_roles`).RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(3))
+
+	_, err = s.query.Returning(`id`).Copy().Run()
+	c.Assert(err, check.ErrorMatches, `COPY cannot be used with RETURNING or ON CONFLICT`)
+}
+
+func (s *UpdateExecTS) SetUpTest(c *check.C) {
 	createTestTables()
 	Register(`t_users`)
 	_, err := Exec(sampleInsert)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	s.query = &Query{
 		queryType: UpdateQuery,
@@ -123,17 +232,17 @@ func (s *UpdateExecTS) SetUpTest(c *C) {
 	}
 }
 
-func (s *UpdateExecTS) TestUpdateTest(c *C) {
+func (s *UpdateExecTS) TestUpdateTest(c *check.C) {
 	data, err := Exec(s.query)
-	c.Assert(err, IsNil)
-	c.Assert(data, IsNil)
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.IsNil)
 
 	data, _ = Exec(sampleSelect)
 	var tests = []testEntry{
-		{`t_users.id`, Equals, `2u`},
+		{`t_users.id`, check.Equals, `2u`},
 		{`t_users.email`, SQLEquals, sql.NullString{Valid: true, String: `luke@skywalker.com`}},
-		{`t_users.age`, Equals, int64(40)},
-		{`t_users.active`, Equals, false},
+		{`t_users.age`, check.Equals, int64(40)},
+		{`t_users.active`, check.Equals, false},
 		{`t_users.email_verified`, SQLEquals, sql.NullBool{Valid: false, Bool: false}},
 		{`t_users.no_of_licenses`, SQLEquals, sql.NullInt64{Valid: true, Int64: int64(0)}},
 		{`t_users.created_at`, SQLEquals, testTime},
@@ -142,11 +251,11 @@ func (s *UpdateExecTS) TestUpdateTest(c *C) {
 	recordCheck(data[0], tests, c)
 }
 
-func (s *DeleteExecTS) SetUpTest(c *C) {
+func (s *DeleteExecTS) SetUpTest(c *check.C) {
 	createTestTables()
 	Register(`t_users`)
 	_, err := Exec(sampleInsert)
-	c.Assert(err, IsNil)
+	c.Assert(err, check.IsNil)
 
 	s.query = &Query{
 		queryType: DeleteQuery,
@@ -155,13 +264,311 @@ func (s *DeleteExecTS) SetUpTest(c *C) {
 	}
 }
 
-func (s *DeleteExecTS) TestDeleteExec(c *C) {
+func (s *DeleteExecTS) TestDeleteExec(c *check.C) {
 	data, err := Exec(s.query)
-	c.Assert(err, IsNil)
-	c.Assert(data, IsNil)
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.IsNil)
 
 	data, _ = Exec(sampleSelect)
-	c.Assert(len(data), Equals, 0)
+	c.Assert(len(data), check.Equals, 0)
 }
 
 // TODO: add Truncate test, dry this up
+
+func (s *TypesExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_items`), check.IsNil)
+}
+
+func (s *TypesExecTS) TestScalarTypes(c *check.C) {
+	releasedOn := getTime(`2014-06-18 00:00:00+00`)
+	_, err := Insert(`t_items`, `id, code, quantity, price, weight, released_on, thumbnail`,
+		int64(1)<<40, `a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11`, 3, `12.50`, 1.5, releasedOn, []byte{0xde, 0xad}).Run()
+	c.Assert(err, check.IsNil)
+
+	data, err := Select(`t_items.id`, `t_items.code`, `t_items.parent_code`, `t_items.quantity`, `t_items.reserved`,
+		`t_items.price`, `t_items.discount`, `t_items.weight`, `t_items.rating`, `t_items.released_on`,
+		`t_items.discontinued_on`, `t_items.thumbnail`, `t_items.manual`).From(`t_items`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+
+	var tests = []testEntry{
+		{`t_items.id`, check.Equals, int64(1) << 40},
+		{`t_items.code`, check.Equals, `a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11`},
+		{`t_items.parent_code`, SQLEquals, sql.NullString{Valid: false}},
+		{`t_items.quantity`, check.Equals, int64(3)},
+		{`t_items.reserved`, SQLEquals, sql.NullInt64{Valid: false}},
+		{`t_items.price`, check.Equals, `12.50`},
+		{`t_items.discount`, SQLEquals, sql.NullString{Valid: false}},
+		{`t_items.weight`, check.Equals, 1.5},
+		{`t_items.rating`, SQLEquals, sql.NullFloat64{Valid: false}},
+		{`t_items.released_on`, SQLEquals, releasedOn},
+		{`t_items.discontinued_on`, SQLEquals, pq.NullTime{Valid: false}},
+		{`t_items.thumbnail`, SQLEquals, []byte{0xde, 0xad}},
+		{`t_items.manual`, SQLEquals, []byte(nil)},
+	}
+	recordCheck(data[0], tests, c)
+}
+
+func (s *JSONExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	defaultMapper = New(defaultMapper.db)
+	c.Assert(Register(`t_events`), check.IsNil)
+
+	_, err := Insert(`t_events`, `id, data, meta`, 1, map[string]interface{}{`kind`: `login`, `tries`: 2}, nil).Run()
+	c.Assert(err, check.IsNil)
+	_, err = Insert(`t_events`, `id, data, meta`, 2, map[string]interface{}{`kind`: `logout`}, struct {
+		Source string `json:"source"`
+	}{`api`}).Run()
+	c.Assert(err, check.IsNil)
+}
+
+func (s *JSONExecTS) TestRawJSON(c *check.C) {
+	data, err := Select(`t_events.id`, `t_events.data`, `t_events.meta`).From(`t_events`).Where(`t_events.data->>'kind' = ?`, `login`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+
+	c.Assert(data[0][`t_events.data`], check.DeepEquals, json.RawMessage(`{"kind": "login", "tries": 2}`))
+	c.Assert(data[0][`t_events.meta`], check.DeepEquals, json.RawMessage(nil))
+}
+
+func (s *JSONExecTS) TestDecodedJSON(c *check.C) {
+	Configure(Configuration{DecodeJSON: true})
+
+	data, err := Select(`t_events.data`, `t_events.meta`).From(`t_events`).Where(`t_events.data @> ?`, map[string]string{`kind`: `logout`}).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+
+	c.Assert(data[0][`t_events.data`], check.DeepEquals, map[string]interface{}{`kind`: `logout`})
+	c.Assert(data[0][`t_events.meta`], check.DeepEquals, map[string]interface{}{`source`: `api`})
+}
+
+func (s *JSONExecTS) TestUpdateJSON(c *check.C) {
+	_, err := Update(`t_events`, `meta = ?`, map[string]interface{}{`source`: `web`}).Where(`id = ?`, 1).Run()
+	c.Assert(err, check.IsNil)
+
+	data, err := Select(`t_events.meta`).From(`t_events`).Where(`t_events.meta->>'source' = ?`, `web`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_events.meta`], check.DeepEquals, json.RawMessage(`{"source":"web"}`))
+}
+
+func (s *ArrayExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_tags`), check.IsNil)
+
+	_, err := Insert(`t_tags`, `id, names, scores, weights, flags`, 1, []string{`go`, `sql`}, []int64{1, 2}, []float64{0.5}, []bool{true, false}).Run()
+	c.Assert(err, check.IsNil)
+	_, err = Insert(`t_tags`, `id, names, scores, weights, flags`, 2, []string{}, nil, nil, nil).Run()
+	c.Assert(err, check.IsNil)
+}
+
+func (s *ArrayExecTS) TestArrays(c *check.C) {
+	data, err := Select(`t_tags.id`, `t_tags.names`, `t_tags.scores`, `t_tags.weights`, `t_tags.flags`).From(`t_tags`).Order(`t_tags.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 2)
+
+	c.Assert(data[0][`t_tags.names`], check.DeepEquals, []string{`go`, `sql`})
+	c.Assert(data[0][`t_tags.scores`], check.DeepEquals, []int64{1, 2})
+	c.Assert(data[0][`t_tags.weights`], check.DeepEquals, []float64{0.5})
+	c.Assert(data[0][`t_tags.flags`], check.DeepEquals, []bool{true, false})
+
+	c.Assert(data[1][`t_tags.names`], check.DeepEquals, []string{})
+	c.Assert(data[1][`t_tags.scores`], check.DeepEquals, []int64(nil))
+}
+
+func (s *ArrayExecTS) TestArrayArgs(c *check.C) {
+	data, err := Select(`t_tags.id`).From(`t_tags`).Where(`t_tags.id = ANY(?)`, []int{2, 3}).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_tags.id`], check.Equals, int64(2))
+
+	_, err = Update(`t_tags`, `names = ?`, []string{`rust`}).Where(`? = ANY(names)`, `go`).Run()
+	c.Assert(err, check.IsNil)
+
+	data, err = Select(`t_tags.names`).From(`t_tags`).Where(`t_tags.id = ?`, 1).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(data[0][`t_tags.names`], check.DeepEquals, []string{`rust`})
+}
+
+func (s *ReturningExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+}
+
+func (s *ReturningExecTS) TestInsertReturning(c *check.C) {
+	q := &Query{
+		queryType: InsertQuery,
+		query:     sampleInsert.query,
+		args:      sampleInsert.args,
+		tables:    []tableName{{name: `t_users`}},
+	}
+	data, err := q.Returning(`id`, `email`, `created_at`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+
+	var tests = []testEntry{
+		{`id`, check.Equals, `2u`},
+		{`email`, SQLEquals, sql.NullString{Valid: true, String: `darth@vader.com`}},
+		{`created_at`, SQLEquals, testTime},
+	}
+	recordCheck(data[0], tests, c)
+}
+
+func (s *ReturningExecTS) TestUpdateDeleteReturning(c *check.C) {
+	_, err := Exec(sampleInsert)
+	c.Assert(err, check.IsNil)
+
+	data, err := Update(`t_users`, `age = age + ?`, 1).Returning(`t_users.id`, `t_users.age`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_users.id`], check.Equals, `2u`)
+	c.Assert(data[0][`t_users.age`], check.Equals, int64(41))
+
+	data, err = Delete(`t_users`).Where(`id = ?`, `2u`).Returning(`no_of_licenses`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`no_of_licenses`], SQLEquals, sql.NullInt64{Valid: true, Int64: 0})
+
+	data, err = Delete(`t_users`).Returning(`id`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 0)
+}
+
+func (s *JoinExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	for _, table := range []string{`t_users`, `t_roles`, `t_user_roles`} {
+		c.Assert(Register(table), check.IsNil)
+	}
+	exec(sampleInsert.query, sampleInsert.args...)
+	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `1u`, `user@test.com`, 20, false, false, 0, nil, testTime)
+	exec(`INSERT INTO t_roles (id, name, required_karma) VALUES ($1, $2, $3), ($4, $5, $6)`, `1r`, `Sith lord`, 9000, `2r`, `Jedi`, 100)
+	exec(`INSERT INTO t_user_roles (id, user_id, role_id) VALUES ($1, $2, $3)`, `1ur`, `2u`, `1r`)
+}
+
+func (s *JoinExecTS) TestLeftJoins(c *check.C) {
+	data, err := Select(`t_users.id`, `t_roles.name`).From(`t_users`).
+		Join(LeftJoin, `t_user_roles`, `t_user_roles.user_id = t_users.id`).
+		Join(LeftJoin, `t_roles`, `t_roles.id = t_user_roles.role_id`).
+		Order(`t_users.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 2)
+	c.Assert(data[0][`t_users.id`], check.Equals, `1u`)
+	c.Assert(data[0][`t_roles.name`], SQLEquals, sql.NullString{})
+	c.Assert(data[1][`t_users.id`], check.Equals, `2u`)
+	c.Assert(data[1][`t_roles.name`], SQLEquals, sql.NullString{Valid: true, String: `Sith lord`})
+}
+
+func (s *JoinExecTS) TestRightAndFullJoins(c *check.C) {
+	data, err := Select(`t_user_roles.user_id`, `t_roles.name`).From(`t_user_roles`).
+		Join(RightJoin, `t_roles`, `t_roles.id = t_user_roles.role_id`).
+		Order(`t_roles.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 2)
+	c.Assert(data[0][`t_user_roles.user_id`], SQLEquals, sql.NullString{Valid: true, String: `2u`})
+	c.Assert(data[1][`t_user_roles.user_id`], SQLEquals, sql.NullString{})
+	c.Assert(data[1][`t_roles.name`], check.Equals, `Jedi`)
+
+	data, err = Select(`t_users.id`, `t_roles.id`).From(`t_users`).
+		Join(FullJoin, `t_roles`, `t_roles.required_karma = t_users.age`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 4)
+
+	data, err = Select(`t_users.id`, `t_roles.id`).From(`t_users`).Join(CrossJoin, `t_roles`, ``).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 4)
+	c.Assert(data[0][`t_users.id`], check.FitsTypeOf, ``)
+}
+
+func (s *ContextTS) TestCheckCanceled(c *check.C) {
+	driverErr := errors.New(`pq: canceling statement due to user request`)
+	c.Assert(checkCanceled(context.Background(), `SELECT 1`, driverErr), check.Equals, driverErr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(checkCanceled(ctx, `SELECT 1`, nil), check.IsNil)
+
+	err := checkCanceled(ctx, `SELECT 1`, driverErr)
+	canceled, ok := err.(*CanceledError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(canceled.Query, check.Equals, `SELECT 1`)
+	c.Assert(errors.Is(err, context.Canceled), check.Equals, true)
+	c.Assert(err.Error(), check.Matches, `.*SELECT 1.*context canceled.*`)
+}
+
+func (s *ContextTS) TestWithTimeout(c *check.C) {
+	m := New(nil)
+	ctx, cancel := m.withTimeout(context.Background())
+	defer cancel()
+	_, ok := ctx.Deadline()
+	c.Assert(ok, check.Equals, false)
+
+	m.Configure(Configuration{StatementTimeout: time.Hour})
+	ctx, cancel = m.withTimeout(context.Background())
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	c.Assert(ok, check.Equals, true)
+	c.Assert(time.Until(deadline) > 59*time.Minute, check.Equals, true)
+
+	// an earlier deadline is kept
+	short, cancelShort := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShort()
+	ctx, cancel = m.withTimeout(short)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	c.Assert(time.Until(deadline) <= time.Second, check.Equals, true)
+}
+
+func (s *ContextExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	defaultMapper = New(defaultMapper.db)
+	c.Assert(Register(`t_users`), check.IsNil)
+	_, err := Exec(sampleInsert)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *ContextExecTS) TearDownTest(c *check.C) {
+	defaultMapper = New(defaultMapper.db)
+}
+
+func (s *ContextExecTS) TestContextTimeout(c *check.C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := Select(`t_users.id`).From(`t_users`).Where(`(SELECT true FROM pg_sleep(?))`, 1).RunContext(ctx)
+	c.Assert(err, check.FitsTypeOf, &CanceledError{})
+	c.Assert(errors.Is(err, context.DeadlineExceeded), check.Equals, true)
+
+	data, err := Select(`t_users.id`).From(`t_users`).RunContext(context.Background())
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+}
+
+func (s *ContextExecTS) TestStatementTimeout(c *check.C) {
+	Configure(Configuration{StatementTimeout: 50 * time.Millisecond})
+
+	_, err := Update(`t_users`, `age = age + 1`).Where(`(SELECT true FROM pg_sleep(?))`, 1).RunCount()
+	c.Assert(err, check.FitsTypeOf, &CanceledError{})
+
+	count, err := Update(`t_users`, `age = age + 1`).RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(1))
+}
+
+func (s *ContextExecTS) TestTxContext(c *check.C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := WithTxContext(ctx, sql.LevelDefault, func(tx *Tx) error {
+		if _, err := tx.ExecCountContext(ctx, Update(`t_users`, `age = ?`, 99)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, Select(`t_users.id`).From(`t_users`).Where(`(SELECT true FROM pg_sleep(?))`, 1))
+		return err
+	})
+	c.Assert(err, check.FitsTypeOf, &CanceledError{})
+
+	data, err := Select(`t_users.age`).From(`t_users`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(data[0][`t_users.age`], check.Equals, int64(40))
+}
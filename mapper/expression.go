@@ -0,0 +1,110 @@
+package mapper
+
+import (
+	`fmt`
+	`github.com/lib/pq`
+)
+
+var (
+	aliasTemplate = `%s AS %s`
+	countTemplate = `count(%s)`
+	sumTemplate   = `sum(%s)`
+	avgTemplate   = `avg(%s)`
+	minTemplate   = `min(%s)`
+	maxTemplate   = `max(%s)`
+)
+
+// Expression is a computed select field (an aggregate, etc). The registry doesn't know it,
+// so its type is declared. Its value is keyed in Records by its alias, or by its sql when there's none
+// A column (Column, As) is an Expression too, its type comes from the registry
+type Expression struct {
+	sql     string // as written in the query
+	name    string // sql with its fields unquoted, the key of the value when there's no alias
+	colType int    // invalidType for registered columns
+	alias   string
+	fields  []string // columns it uses, which must be registered
+}
+
+// Expr is a select field computed by sql (`lower(t_users.email)`, `now()`, etc), scanned as colType
+// sql is used as it is, it shouldn't come from users
+func Expr(sql string, colType int) Expression {
+	return Expression{sql: sql, name: sql, colType: colType}
+}
+
+// Column is a registered column ("t_users.email" or "email") as it is, to mix with other Expressions in SelectExpr
+func Column(column string) Expression {
+	return Expression{sql: quoteIdentifier(column), name: column, colType: invalidType}
+}
+
+// As renames a registered column ("t_users.email" or "email"), in the query and in the Records
+func As(column, alias string) Expression {
+	return Expression{sql: quoteIdentifier(column), name: column, colType: invalidType, alias: alias}
+}
+
+// aggregate applies an aggregate function template to a field
+func aggregate(template, field string, colType int) Expression {
+	e := Expression{
+		sql:     fmt.Sprintf(template, quoteIdentifier(field)),
+		name:    fmt.Sprintf(template, field),
+		colType: colType,
+	}
+	if field != `*` {
+		e.fields = []string{field}
+	}
+	return e
+}
+
+// As names the expression, in the query and in the Records
+func (e Expression) As(alias string) Expression {
+	e.alias = alias
+	return e
+}
+
+// isColumn tells if the expression is a registered column which isn't renamed
+func (e Expression) isColumn() bool {
+	return e.colType == invalidType && e.alias == ``
+}
+
+// key gives the name of the expression in Records
+func (e Expression) key() string {
+	if e.alias != `` {
+		return e.alias
+	}
+	return e.name
+}
+
+// String gives the expression as it's written in the select
+func (e Expression) String() string {
+	if e.alias != `` {
+		return fmt.Sprintf(aliasTemplate, e.sql, pq.QuoteIdentifier(e.alias))
+	}
+	return e.sql
+}
+
+// Count is count(field), use `*` to count the rows. It never is NULL
+func Count(field string) Expression {
+	return aggregate(countTemplate, field, Int64Type)
+}
+
+// The aggregates below are NULL when there's no row, so a Null... type is safer unless the query is grouped
+// Note that postgres gives numeric for sum/avg of bigint and avg of integer (NumericType / NullNumericType)
+
+// Sum is sum(field), of type colType
+func Sum(field string, colType int) Expression {
+	return aggregate(sumTemplate, field, colType)
+}
+
+// Avg is avg(field), of type colType
+func Avg(field string, colType int) Expression {
+	return aggregate(avgTemplate, field, colType)
+}
+
+// Min is min(field), of type colType
+func Min(field string, colType int) Expression {
+	return aggregate(minTemplate, field, colType)
+}
+
+// Max is max(field), of type colType
+func Max(field string, colType int) Expression {
+	return aggregate(maxTemplate, field, colType)
+}
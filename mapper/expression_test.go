@@ -0,0 +1,110 @@
+package mapper
+
+import (
+	`database/sql`
+	. `github.com/viki-org/gomods/sqlcheckers`
+	`gopkg.in/check.v1`
+)
+
+type ExpressionTS struct{}
+
+type ExpressionExecTS struct{}
+
+func init() {
+	check.Suite(&ExpressionTS{})
+	check.Suite(&ExpressionExecTS{})
+}
+
+func (s *ExpressionTS) TestAggregates(c *check.C) {
+	q := SelectExpr(Column(`t_users.active`), Count(`*`).As(`total`), Max(`t_users.age`, Int64Type), Avg(`t_users.age`, NumericType).As(`avg_age`)).
+		From(`t_users`).Where(`t_users.email_verified = ?`, true).
+		GroupBy(`t_users.active`).Having(`count(*) > ?`, 1).Having(Raw(`max(t_users.age) < ?`, 60)).
+		Order(`total`, Desc)
+	testQuery(c, q, SelectQuery,
+		`SELECT "t_users"."active", count(*) AS "total", max("t_users"."age"), avg("t_users"."age") AS "avg_age" FROM "t_users" WHERE t_users.email_verified = $1 GROUP BY "t_users"."active" HAVING (count(*) > $2) AND (max(t_users.age) < $3) ORDER BY "total" DESC`,
+		[]string{`t_users.active`, `total`, `max(t_users.age)`, `avg_age`},
+		[]interface{}{true, 1, 60},
+	)
+	c.Assert(q.exprTypes, check.DeepEquals, map[string]int{`total`: Int64Type, `max(t_users.age)`: Int64Type, `avg_age`: NumericType})
+
+	c.Assert(Sum(`t_tags.id`, NullInt64Type).String(), check.Equals, `sum("t_tags"."id")`)
+	c.Assert(Min(`t_users.created_at`, NullTimeType).As(`first`).String(), check.Equals, `min("t_users"."created_at") AS "first"`)
+}
+
+func (s *ExpressionTS) TestAliases(c *check.C) {
+	q := SelectExpr(As(`t_users.email`, `email`), Expr(`lower(t_users.email)`, NullStringType).As(`email_lc`), Expr(`now()`, TimeType), Column(`t_users.id`)).From(`t_users`)
+	testQuery(c, q, SelectQuery,
+		`SELECT "t_users"."email" AS "email", lower(t_users.email) AS "email_lc", now(), "t_users"."id" FROM "t_users"`,
+		[]string{`email`, `email_lc`, `now()`, `t_users.id`},
+		nil,
+	)
+	c.Assert(q.aliases, check.DeepEquals, map[string]string{`email`: `t_users.email`})
+	c.Assert(q.exprTypes, check.DeepEquals, map[string]int{`email_lc`: NullStringType, `now()`: TimeType})
+
+	m := New(nil)
+	m.registry.add(map[string]int{`public.t_users.email`: NullStringType, `public.t_users.id`: StringType})
+	q.mapper = m
+	_, colTypes, err := m.createPlaceholders(q)
+	c.Assert(err, check.IsNil)
+	c.Assert(colTypes, check.DeepEquals, []int{NullStringType, NullStringType, TimeType, StringType})
+
+	_, _, err = m.createPlaceholders(m.SelectExpr(As(`t_users.name`, `name`)).From(`t_users`))
+	c.Assert(err, check.NotNil)
+}
+
+func (s *ExpressionTS) TestSelectColumns(c *check.C) {
+	fields := []string{`t_users.id`, `t_users.email`}
+	q := Select(fields...).From(`t_users`)
+	c.Assert(q.sql(), check.Equals, SelectExpr(Column(`t_users.id`), Column(`t_users.email`)).From(`t_users`).sql())
+	c.Assert(q.selectFields, check.DeepEquals, fields)
+	c.Assert(q.aliases, check.IsNil)
+	c.Assert(q.exprTypes, check.IsNil)
+}
+
+func (s *ExpressionExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+	exec(sampleInsert.query, sampleInsert.args...)
+	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `1u`, `user@test.com`, 20, false, false, 0, nil, testTime)
+	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `3u`, `luke@skywalker.com`, 19, true, true, 2, nil, testTime)
+}
+
+func (s *ExpressionExecTS) TestGroupBy(c *check.C) {
+	data, err := SelectExpr(Column(`t_users.active`), Count(`*`).As(`total`), Sum(`t_users.no_of_licenses`, Int64Type).As(`licenses`), Max(`t_users.age`, Int64Type)).
+		From(`t_users`).GroupBy(`t_users.active`).Having(`count(*) > ?`, 1).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+
+	var tests = []testEntry{
+		{`t_users.active`, check.Equals, true},
+		{`total`, check.Equals, int64(2)},
+		{`licenses`, check.Equals, int64(2)},
+		{`max(t_users.age)`, check.Equals, int64(40)},
+	}
+	recordCheck(data[0], tests, c)
+}
+
+func (s *ExpressionExecTS) TestEmptyAggregates(c *check.C) {
+	data, err := SelectExpr(Count(`*`).As(`total`), Min(`t_users.age`, NullInt64Type).As(`youngest`), Avg(`t_users.age`, NullNumericType).As(`avg_age`)).
+		From(`t_users`).Where(`t_users.age > ?`, 100).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`total`], check.Equals, int64(0))
+	c.Assert(data[0][`youngest`], SQLEquals, sql.NullInt64{})
+	c.Assert(data[0][`avg_age`], SQLEquals, sql.NullString{})
+}
+
+func (s *ExpressionExecTS) TestAliasesAndExpr(c *check.C) {
+	data, err := SelectExpr(As(`t_users.id`, `id`), Expr(`upper(t_users.email)`, NullStringType).As(`email_uc`), Expr(`t_users.age * 2`, Int64Type).As(`double_age`)).
+		From(`t_users`).Where(`t_users.id = ?`, `2u`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+
+	var tests = []testEntry{
+		{`id`, check.Equals, `2u`},
+		{`email_uc`, SQLEquals, sql.NullString{Valid: true, String: `DARTH@VADER.COM`}},
+		{`double_age`, check.Equals, int64(80)},
+	}
+	recordCheck(data[0], tests, c)
+	c.Assert(len(data[0]), check.Equals, 3)
+}
@@ -3,7 +3,7 @@ package mapper
 import (
 	`fmt`
 	`github.com/exklamationmark/glog`
-	. `gopkg.in/check.v1`
+	`gopkg.in/check.v1`
 	`time`
 )
 
@@ -18,13 +18,13 @@ func getTime(timeStr string) time.Time {
 
 type testEntry struct {
 	target     interface{}
-	comparator Checker
+	comparator check.Checker
 	value      interface{}
 }
 
 // perform tests based on table, to dry up similar test cases
 // 2 transformers can be given, first one for target, 2nd for value
-func tableCheck(c *C, tests []testEntry, transformers ...func(interface{}) interface{}) {
+func tableCheck(c *check.C, tests []testEntry, transformers ...func(interface{}) interface{}) {
 	var targetT, valueT func(interface{}) interface{}
 	//var targetT, valueT testTransformer
 	var target, value interface{}
@@ -50,7 +50,7 @@ func tableCheck(c *C, tests []testEntry, transformers ...func(interface{}) inter
 }
 
 // transform the target into actual value from a Record map
-func recordCheck(rec Record, tests []testEntry, c *C) {
+func recordCheck(rec Record, tests []testEntry, c *check.C) {
 	for _, test := range tests {
 		c.Assert(rec[test.target.(string)], test.comparator, test.value)
 	}
@@ -58,7 +58,7 @@ func recordCheck(rec Record, tests []testEntry, c *C) {
 
 // a wrapper, so don't have to do error check
 func exec(query string, args ...interface{}) {
-	_, err := dbconnection.Exec(query, args...)
+	_, err := defaultMapper.db.Exec(query, args...)
 	if err != nil {
 		glog.Fatal(fmt.Sprintf(`error running query, query= %v; args= %v; err= %v`, query, args, err))
 	}
@@ -66,7 +66,7 @@ func exec(query string, args ...interface{}) {
 
 // fixture: create a fake table to test, something similar to a user record
 func createTestTables() {
-	exec(`DROP TABLE IF EXISTS t_users, t_roles, t_user_roles`)
+	exec(`DROP TABLE IF EXISTS t_users, t_roles, t_user_roles, t_places, t_items, t_events, t_tags`)
 	exec(`CREATE TABLE t_users (
 		id character varying(15) NOT NULL PRIMARY KEY,
 		email character varying(255),
@@ -88,15 +88,58 @@ func createTestTables() {
 		role_id character varying(15) NOT NULL
 	)`)
 	exec(`CREATE UNIQUE INDEX ON t_user_roles (user_id, role_id)`)
-	exec(`TRUNCATE TABLE t_users, t_roles, t_user_roles`)
+	// t_places has columns mapper doesn't support
+	exec(`CREATE TABLE t_places (
+		id character varying(15) NOT NULL PRIMARY KEY,
+		name text NOT NULL,
+		location point,
+		search tsvector
+	)`)
+	// t_items covers the other scalar types, with a nullable column for each
+	exec(`CREATE TABLE t_items (
+		id bigint NOT NULL PRIMARY KEY,
+		code uuid NOT NULL,
+		parent_code uuid,
+		quantity smallint NOT NULL,
+		reserved smallint,
+		price numeric(10, 2) NOT NULL,
+		discount numeric(10, 2),
+		weight real NOT NULL,
+		rating double precision,
+		released_on date NOT NULL,
+		discontinued_on date,
+		thumbnail bytea NOT NULL,
+		manual bytea
+	)`)
+	exec(`CREATE TABLE t_events (
+		id integer NOT NULL PRIMARY KEY,
+		data jsonb NOT NULL,
+		meta json
+	)`)
+	exec(`CREATE TABLE t_tags (
+		id integer NOT NULL PRIMARY KEY,
+		names text[] NOT NULL,
+		scores integer[],
+		weights double precision[],
+		flags boolean[]
+	)`)
+	// a table with the same name as t_users, in another schema
+	exec(`DROP SCHEMA IF EXISTS t_audit CASCADE`)
+	exec(`CREATE SCHEMA t_audit`)
+	exec(`CREATE TABLE t_audit.t_users (
+		id integer NOT NULL PRIMARY KEY,
+		action text NOT NULL,
+		created_at timestamp with time zone NOT NULL
+	)`)
+	exec(`TRUNCATE TABLE t_users, t_roles, t_user_roles, t_places, t_items, t_events, t_tags`)
 }
 
-func testQuery(c *C, q *Query, queryType int, query string, selectFields []string, args []interface{}) {
+func testQuery(c *check.C, q *Query, queryType int, query string, selectFields []string, args []interface{}) {
 	var tests = []testEntry{
-		{q.queryType, Equals, queryType},
-		{q.query, Equals, query},
-		{q.selectFields, DeepEquals, selectFields},
-		{q.args, DeepEquals, args},
+		{q.queryType, check.Equals, queryType},
+		{q.sql(), check.Equals, query},
+		{q.selectFields, check.DeepEquals, selectFields},
+		{q.args, check.DeepEquals, args},
 	}
 	tableCheck(c, tests)
 }
@@ -1,11 +1,18 @@
 // Pacakge mapper provide a cleaner query interface for postgres
 // We start by connecting mapper to an existing db connection, then register tables in there
 // After that query can be constructed and the result will be put into a map
+//
+// The package-level functions work on a default Mapper, set up by Connect.
+// To talk to more than one database, create a Mapper per connection with New
 package mapper
 
 import (
+	`context`
+	`database/sql`
 	`fmt`
 	`github.com/exklamationmark/glog`
+	`strings`
+	`time`
 )
 
 const (
@@ -14,54 +21,399 @@ const (
 	initTotalColCount = initColCount * initTableCount
 )
 
+// types of the columns, from the schemas given by Register, or declared for computed fields (Count, Sum, etc)
 const (
-	stringType = iota
-	nullStringType
-	int64Type
-	nullInt64Type
-	boolType
-	nullBoolType
-	timeType
-	nullTimeType
+	StringType = iota
+	NullStringType
+	Int64Type
+	NullInt64Type
+	BoolType
+	NullBoolType
+	TimeType
+	NullTimeType
+	Float64Type
+	NullFloat64Type
+	NumericType     // numeric is kept as text (string), so no precision is lost
+	NullNumericType // sql.NullString
+	BytesType
+	NullBytesType // []byte, nil for NULL
+	JSONType      // json.RawMessage, or decoded values, see Configuration.DecodeJSON
+	NullJSONType
+	// one-dimensional arrays, NULL gives a nil slice. Elements can't be NULL
+	StringArrayType
+	Int64ArrayType
+	Float64ArrayType
+	BoolArrayType
 	invalidType
 )
 
 var (
-	schemaQuery = `SELECT column_name, data_type, is_nullable FROM information_schema.columns WHERE table_name = '%s'`
+	schemaQuery = `SELECT column_name, data_type, udt_name, is_nullable FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2`
 
-	invalidTypeErr      = `invalid sql data type, got "%v", expected one of ("character varying", "text", "integer", "boolean", "timestamp with time zone", "timestamp without time zone")`
+	defaultSearchPath = []string{`public`}
+
+	// information_schema gives "ARRAY" as data_type for all arrays, udt_name tells the element type
+	arrayDataType = `ARRAY`
+
+	invalidTypeErr      = `invalid sql data type, got "%v", expected one of ("character varying", "character", "text", "inet", "uuid", "smallint", "integer", "bigint", "real", "double precision", "numeric", "boolean", "date", "timestamp with time zone", "timestamp without time zone", "bytea", "json", "jsonb")`
+	invalidArrayTypeErr = `invalid sql array type, got "%v", expected an array of one of ("character varying", "character", "text", "uuid", "smallint", "integer", "bigint", "real", "double precision", "boolean")`
 	invalidNullableErr  = `invalid value for nullable, got "%v", expected one of ("YES", "NO")`
 	cannotLoadSchemaErr = `cannot load schema, error= %v`
+	tableNotFoundErr    = `cannot load schema, table "%s" has no columns or does not exist`
+	columnErr           = `column "%s" (%s, nullable=%s): %v`
+	registerErr         = `cannot register table "%s": %s`
+	skipColumnMsg       = `skipping unsupported column of table "%s": %v`
+
+	// defaultMapper backs the package-level functions
+	defaultMapper = New(nil)
+)
+
+// Mapper holds a db connection and the schemas of tables registered through it
+// Each Mapper has its own registry, so different mappers can talk to different databases
+type Mapper struct {
+	db       *sql.DB
+	config   Configuration
+	registry *registry
+	stmts    *stmtCache // nil unless Configuration.StatementCacheSize is set
+}
+
+// New creates a mapper on top of an existing db connection
+func New(conn *sql.DB) *Mapper {
+	return &Mapper{
+		db:       conn,
+		registry: newRegistry(),
+	}
+}
+
+// Connect register a db connection to the module. Must be called to init mapper
+func Connect(conn *sql.DB) {
+	defaultMapper.db = conn
+}
+
+// Configuration stores configurations for mapper
+type Configuration struct {
+	// SkipUnsupportedColumns makes Register leave out columns it cannot map to a Go type,
+	// instead of failing for the whole table. Skipped columns can't be selected later
+	SkipUnsupportedColumns bool
+
+	// SearchPath lists the schemas to look into for table names without a schema, in order
+	// Defaults to "public", like postgres
+	SearchPath []string
+
+	// DecodeJSON makes json and jsonb columns come back decoded: objects as map[string]interface{},
+	// arrays as []interface{}, etc. By default they come back as json.RawMessage
+	DecodeJSON bool
+
+	// MaxTxRetries is how many times WithTx runs a transaction again after a serialization failure or a deadlock
+	// 0 means the default (3), a negative value disables retries
+	MaxTxRetries int
+
+	// StatementTimeout, when set, stops every query running longer than that with a *CanceledError
+	// Contexts given to the ...Context functions can only make it shorter
+	StatementTimeout time.Duration
+
+	// StatementCacheSize, when set, keeps up to that many prepared statements, keyed by their sql, the least recently
+	// used one is closed to make room. Queries of the same shape (same sql, other args) are then parsed once. See StatementCacheStats
+	// A statement is prepared the second time it's run outside of a transaction, bulk inserts never are.
+	// Transactions only use the statements already prepared. Registering a table empties the cache
+	StatementCacheSize int
+}
+
+// Configure setup the mapper. It should be called before registering tables, and before running queries
+// Statements of the previous cache are closed
+func (m *Mapper) Configure(config Configuration) {
+	m.config = config
+	if m.stmts != nil {
+		m.stmts.purge()
+		m.stmts = nil
+	}
+	if config.StatementCacheSize > 0 {
+		m.stmts = newStmtCache(config.StatementCacheSize)
+	}
+}
+
+// Configure setup the default mapper. It should be called before registering tables
+func Configure(config Configuration) {
+	defaultMapper.Configure(config)
+}
+
+// searchPath returns the schemas to look into for unqualified table names
+func (m *Mapper) searchPath() []string {
+	if len(m.config.SearchPath) == 0 {
+		return defaultSearchPath
+	}
+	return m.config.SearchPath
+}
+
+// tableName is a table name, optionally qualified by its schema
+type tableName struct {
+	schema, name string
+	outer        bool // on the nullable side of an outer join, its columns can be NULL whatever the schema says
+}
+
+// parseTable splits "schema.table" into its parts, schema is empty for unqualified names
+func parseTable(name string) tableName {
+	if dot := strings.Index(name, `.`); dot >= 0 {
+		return tableName{schema: name[:dot], name: name[dot+1:]}
+	}
+	return tableName{name: name}
+}
+
+func (tb tableName) String() string {
+	if tb.schema == `` {
+		return tb.name
+	}
+	return tb.schema + `.` + tb.name
+}
+
+// columnType finds the registered type of a selected field, which can be "column", "table.column"
+// or "schema.table.column". Tables named in the query decide the schema when the field doesn't have one,
+// otherwise the search path is used. ok is false when the field isn't registered
+func (m *Mapper) columnType(tables []tableName, field string) (colType int, ok bool) {
+	columns := m.registry.load()
+	parts := strings.Split(field, `.`)
+	var candidates []tableName
+	switch len(parts) {
+	case 3:
+		if colType, ok = columns[field]; ok && isOuter(tables, parts[0], parts[1]) {
+			colType = nullableType(colType)
+		}
+		return
+	case 2:
+		for _, tb := range tables {
+			if tb.name == parts[0] {
+				candidates = append(candidates, tb)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = []tableName{{name: parts[0]}}
+		}
+	case 1:
+		candidates = tables
+	}
+
+	column := parts[len(parts)-1]
+	for _, tb := range candidates {
+		schemas := []string{tb.schema}
+		if tb.schema == `` {
+			schemas = m.searchPath()
+		}
+		for _, schema := range schemas {
+			if colType, ok = columns[schema+`.`+tb.name+`.`+column]; ok {
+				if tb.outer {
+					colType = nullableType(colType)
+				}
+				return
+			}
+		}
+	}
+	return invalidType, false
+}
 
-	//tables = make(map[string]*Table, initTableCount)
-	columns = make(map[string]int, initTotalColCount)
+// tableRegistered tells if a table has registered columns, an unqualified table is looked up in the search path
+func (m *Mapper) tableRegistered(tb tableName) bool {
+	if tb.schema == `` {
+		_, ok := m.tableSchema(tb.name)
+		return ok
+	}
+	return m.registry.hasTable(tb.schema + `.` + tb.name)
+}
+
+// tableSchema gives the first schema of the search path where the table has registered columns
+func (m *Mapper) tableSchema(name string) (string, bool) {
+	for _, schema := range m.searchPath() {
+		if m.registry.hasTable(schema + `.` + name) {
+			return schema, true
+		}
+	}
+	return ``, false
+}
+
+// resolveTable qualifies a table by the schema it's registered in, when Configuration.SearchPath is set:
+// postgres looks unqualified tables up in the search_path of the connection, not in ours
+// With the default search path, both use "public" and the table is left as it is
+func (m *Mapper) resolveTable(table string) tableName {
+	tb := parseTable(table)
+	if tb.schema != `` || len(m.config.SearchPath) == 0 || !identifierPattern.MatchString(table) {
+		return tb
+	}
+	if schema, ok := m.tableSchema(tb.name); ok {
+		tb.schema = schema
+	}
+	return tb
+}
+
+// isOuter tells if schema.table is on the nullable side of an outer join of the query
+func isOuter(tables []tableName, schema, name string) bool {
+	for _, tb := range tables {
+		if tb.outer && tb.name == name && (tb.schema == schema || tb.schema == ``) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	nullableTypes = map[int]int{
+		StringType:  NullStringType,
+		Int64Type:   NullInt64Type,
+		BoolType:    NullBoolType,
+		TimeType:    NullTimeType,
+		Float64Type: NullFloat64Type,
+		NumericType: NullNumericType,
+		BytesType:   NullBytesType,
+		JSONType:    NullJSONType,
+	}
 )
 
+// nullableType gives the NULL-able version of a type, arrays already scan NULL as a nil slice
+func nullableType(colType int) int {
+	if nullable, ok := nullableTypes[colType]; ok {
+		return nullable
+	}
+	return colType
+}
+
+// ColumnError describes a column that Register cannot map to a Go type
+type ColumnError struct {
+	Column   string
+	DataType string
+	Nullable string
+	Err      error
+}
+
+func (e ColumnError) Error() string {
+	return fmt.Sprintf(columnErr, e.Column, e.DataType, e.Nullable, e.Err)
+}
+
+// RegisterError is returned by Register when some columns of a table cannot be mapped.
+// It lists every bad column, not only the first one
+type RegisterError struct {
+	Table   string
+	Columns []ColumnError
+}
+
+func (e *RegisterError) Error() string {
+	msgs := make([]string, 0, len(e.Columns))
+	for _, col := range e.Columns {
+		msgs = append(msgs, col.Error())
+	}
+	return fmt.Sprintf(registerErr, e.Table, strings.Join(msgs, `; `))
+}
+
 // Register query the db for a table's schema and store them for later use
-func Register(tbName string) {
-	rows, err := dbconnection.Query(fmt.Sprintf(schemaQuery, tbName))
-	defer rows.Close()
-	if err != nil {
-		glog.Fatal(fmt.Errorf(cannotLoadSchemaErr, err))
+// The table name can be qualified with a schema ("audit.users"). Unqualified names are looked up
+// in the schemas of Configuration.SearchPath, and the first schema having the table wins
+// If any column can't be mapped, a *RegisterError is returned and nothing from the table is stored,
+// unless Configuration.SkipUnsupportedColumns is set
+func (m *Mapper) Register(tbName string) error {
+	return m.RegisterContext(context.Background(), tbName)
+}
+
+// RegisterContext is Register, stopped when ctx is done
+func (m *Mapper) RegisterContext(ctx context.Context, tbName string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	tb := parseTable(tbName)
+	schemas := []string{tb.schema}
+	if tb.schema == `` {
+		schemas = m.searchPath()
+	}
+
+	var tbColumns map[string]int
+	var badColumns []ColumnError
+	for _, schema := range schemas {
+		tb.schema = schema
+		var err error
+		if tbColumns, badColumns, err = m.loadTable(ctx, tb); err != nil {
+			return err
+		}
+		if len(tbColumns) > 0 || len(badColumns) > 0 {
+			break
+		}
+	}
+
+	if len(tbColumns) == 0 && len(badColumns) == 0 {
+		return fmt.Errorf(tableNotFoundErr, tbName)
 	}
 
+	if len(badColumns) > 0 {
+		if !m.config.SkipUnsupportedColumns {
+			return &RegisterError{Table: tb.String(), Columns: badColumns}
+		}
+		for _, col := range badColumns {
+			glog.Info(fmt.Sprintf(skipColumnMsg, tb, col))
+		}
+	}
+
+	m.registry.add(tbColumns)
+	// the plans of prepared statements on the table may be stale after a DDL
+	if m.stmts != nil {
+		m.stmts.purge()
+	}
+	return nil
+}
+
+// loadTable reads the columns of a schema-qualified table
+// columns that can be mapped are keyed by schema.table.column, the rest are returned as errors
+func (m *Mapper) loadTable(ctx context.Context, tb tableName) (map[string]int, []ColumnError, error) {
+	rows, err := m.db.QueryContext(ctx, schemaQuery, tb.schema, tb.name)
+	if err != nil {
+		return nil, nil, checkCanceled(ctx, schemaQuery, fmt.Errorf(cannotLoadSchemaErr, err))
+	}
 	defer rows.Close()
-	var colName, dataType, nullable string
+
+	tbColumns := make(map[string]int, initColCount)
+	var badColumns []ColumnError
+	var colName, dataType, udtName, nullable string
 	for rows.Next() {
-		if err := rows.Scan(&colName, &dataType, &nullable); err != nil {
-			glog.Fatal(fmt.Errorf(cannotLoadSchemaErr, err))
-			continue
+		if err := rows.Scan(&colName, &dataType, &udtName, &nullable); err != nil {
+			return nil, nil, fmt.Errorf(cannotLoadSchemaErr, err)
 		}
 
-		colType, err := toType(dataType, nullable)
+		var colType int
+		if dataType == arrayDataType {
+			colType, err = toArrayType(udtName, nullable)
+		} else {
+			colType, err = toType(dataType, nullable)
+		}
 		if err != nil {
-			glog.Fatal(fmt.Errorf(cannotLoadSchemaErr, err))
+			badColumns = append(badColumns, ColumnError{Column: colName, DataType: dataType, Nullable: nullable, Err: err})
+			continue
 		}
 
-		columns[tbName+`.`+colName] = colType
+		tbColumns[tb.String()+`.`+colName] = colType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, checkCanceled(ctx, schemaQuery, fmt.Errorf(cannotLoadSchemaErr, err))
+	}
+	return tbColumns, badColumns, nil
+}
+
+// Register query the db for a table's schema and store them in the default mapper
+func Register(tbName string) error {
+	return defaultMapper.Register(tbName)
+}
+
+// RegisterContext query the db for a table's schema and store them in the default mapper, stopped when ctx is done
+func RegisterContext(ctx context.Context, tbName string) error {
+	return defaultMapper.RegisterContext(ctx, tbName)
+}
+
+// MustRegister is like Register, but stops the program when the table cannot be registered.
+// Useful in init(), where there's no sensible way to continue without the schema
+func (m *Mapper) MustRegister(tbName string) {
+	if err := m.Register(tbName); err != nil {
+		glog.Fatal(err)
 	}
 }
 
+// MustRegister is like Register, but stops the program when the table cannot be registered
+func MustRegister(tbName string) {
+	defaultMapper.MustRegister(tbName)
+}
+
 // toType returns the corresponding Golang type for a sql data_type
 func toType(dataType, nullable string) (int, error) {
 	if nullable != `NO` && nullable != `YES` {
@@ -69,27 +421,68 @@ func toType(dataType, nullable string) (int, error) {
 	}
 
 	switch dataType {
-	case `character varying`, `text`, `inet`:
+	case `character varying`, `character`, `text`, `inet`, `uuid`:
 		if nullable == `NO` {
-			return stringType, nil
+			return StringType, nil
 		}
-		return nullStringType, nil
-	case `integer`:
+		return NullStringType, nil
+	case `smallint`, `integer`, `bigint`:
 		if nullable == `NO` {
-			return int64Type, nil
+			return Int64Type, nil
 		}
-		return nullInt64Type, nil
+		return NullInt64Type, nil
 	case `boolean`:
 		if nullable == `NO` {
-			return boolType, nil
+			return BoolType, nil
 		}
-		return nullBoolType, nil
-	case `timestamp with time zone`, `timestamp without time zone`:
+		return NullBoolType, nil
+	case `date`, `timestamp with time zone`, `timestamp without time zone`:
 		if nullable == `NO` {
-			return timeType, nil
+			return TimeType, nil
 		}
-		return nullTimeType, nil
+		return NullTimeType, nil
+	case `real`, `double precision`:
+		if nullable == `NO` {
+			return Float64Type, nil
+		}
+		return NullFloat64Type, nil
+	case `numeric`:
+		if nullable == `NO` {
+			return NumericType, nil
+		}
+		return NullNumericType, nil
+	case `bytea`:
+		if nullable == `NO` {
+			return BytesType, nil
+		}
+		return NullBytesType, nil
+	case `json`, `jsonb`:
+		if nullable == `NO` {
+			return JSONType, nil
+		}
+		return NullJSONType, nil
 	}
 
 	return invalidType, fmt.Errorf(invalidTypeErr, dataType)
 }
+
+// toArrayType returns the corresponding Golang slice type for an array column, from its udt_name
+// udt_name of an array is the element type's name prefixed by "_", e.g. "_int4" for integer[]
+func toArrayType(udtName, nullable string) (int, error) {
+	if nullable != `NO` && nullable != `YES` {
+		return invalidType, fmt.Errorf(invalidNullableErr, nullable)
+	}
+
+	switch udtName {
+	case `_varchar`, `_bpchar`, `_text`, `_uuid`:
+		return StringArrayType, nil
+	case `_int2`, `_int4`, `_int8`:
+		return Int64ArrayType, nil
+	case `_float4`, `_float8`:
+		return Float64ArrayType, nil
+	case `_bool`:
+		return BoolArrayType, nil
+	}
+
+	return invalidType, fmt.Errorf(invalidArrayTypeErr, udtName)
+}
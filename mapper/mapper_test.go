@@ -1,12 +1,12 @@
 package mapper
 
 import (
-	. `gopkg.in/check.v1`
+	`gopkg.in/check.v1`
 	`testing`
 )
 
 func Test(t *testing.T) {
-	TestingT(t)
+	check.TestingT(t)
 }
 
 type SchemaTS struct{}
@@ -16,60 +16,232 @@ type SchemaRegisterTS struct {
 }
 
 func init() {
-	Suite(&SchemaTS{})
-	Suite(&SchemaRegisterTS{})
+	check.Suite(&SchemaTS{})
+	check.Suite(&SchemaRegisterTS{})
 }
 
-func (s *SchemaRegisterTS) SetUpTest(c *C) {
+func (s *SchemaRegisterTS) SetUpTest(c *check.C) {
 	createTestTables()
+	defaultMapper = New(defaultMapper.db)
 }
 
-func (s *SchemaRegisterTS) TestRegister(c *C) {
-	Register(`t_users`)
+func (s *SchemaRegisterTS) TestRegister(c *check.C) {
+	c.Assert(Register(`t_users`), check.IsNil)
 
-	c.Assert(len(columns), Equals, 8)
+	c.Assert(len(defaultMapper.registry.load()), check.Equals, 8)
 	var tests = []testEntry{
-		{`t_users.id`, Equals, stringType},
-		{`t_users.email`, Equals, nullStringType},
-		{`t_users.age`, Equals, int64Type},
-		{`t_users.active`, Equals, boolType},
-		{`t_users.email_verified`, Equals, nullBoolType},
-		{`t_users.no_of_licenses`, Equals, nullInt64Type},
-		{`t_users.last_payment_at`, Equals, nullTimeType},
-		{`t_users.created_at`, Equals, timeType},
+		{`public.t_users.id`, check.Equals, StringType},
+		{`public.t_users.email`, check.Equals, NullStringType},
+		{`public.t_users.age`, check.Equals, Int64Type},
+		{`public.t_users.active`, check.Equals, BoolType},
+		{`public.t_users.email_verified`, check.Equals, NullBoolType},
+		{`public.t_users.no_of_licenses`, check.Equals, NullInt64Type},
+		{`public.t_users.last_payment_at`, check.Equals, NullTimeType},
+		{`public.t_users.created_at`, check.Equals, TimeType},
 	}
 	tableCheck(c, tests, func(target interface{}) interface{} {
-		return columns[target.(string)]
+		return defaultMapper.registry.load()[target.(string)]
 	})
 }
 
+func (s *SchemaRegisterTS) TestRegisterUnsupportedColumns(c *check.C) {
+	err := Register(`t_places`)
+
+	regErr, ok := err.(*RegisterError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(regErr.Table, check.Equals, `t_places`)
+	c.Assert(len(regErr.Columns), check.Equals, 2)
+	for _, col := range regErr.Columns {
+		c.Assert(col.Column == `location` || col.Column == `search`, check.Equals, true)
+		c.Assert(col.Nullable, check.Equals, `YES`)
+	}
+	c.Assert(len(defaultMapper.registry.load()), check.Equals, 0)
+}
+
+func (s *SchemaRegisterTS) TestRegisterSkipUnsupportedColumns(c *check.C) {
+	Configure(Configuration{SkipUnsupportedColumns: true})
+
+	c.Assert(Register(`t_places`), check.IsNil)
+	c.Assert(len(defaultMapper.registry.load()), check.Equals, 2)
+	c.Assert(defaultMapper.registry.load()[`public.t_places.id`], check.Equals, StringType)
+	c.Assert(defaultMapper.registry.load()[`public.t_places.name`], check.Equals, StringType)
+}
+
+func (s *SchemaRegisterTS) TestSeparateMappers(c *check.C) {
+	m := New(defaultMapper.db)
+	c.Assert(m.Register(`t_roles`), check.IsNil)
+	c.Assert(Register(`t_users`), check.IsNil)
+
+	c.Assert(len(m.registry.load()), check.Equals, 3)
+	c.Assert(len(defaultMapper.registry.load()), check.Equals, 8)
+
+	c.Assert(m.Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100).mapper, check.Equals, m)
+	c.Assert(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100).mapper, check.Equals, defaultMapper)
+
+	_, err := m.Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100).Run()
+	c.Assert(err, check.IsNil)
+	data, err := m.Select(`t_roles.name`, `t_roles.required_karma`).From(`t_roles`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_roles.required_karma`], check.Equals, int64(100))
+}
+
+func (s *SchemaRegisterTS) TestRegisterWithSchema(c *check.C) {
+	c.Assert(Register(`t_users`), check.IsNil)
+	c.Assert(Register(`t_audit.t_users`), check.IsNil)
+
+	c.Assert(len(defaultMapper.registry.load()), check.Equals, 11)
+	c.Assert(defaultMapper.registry.load()[`public.t_users.id`], check.Equals, StringType)
+	c.Assert(defaultMapper.registry.load()[`t_audit.t_users.id`], check.Equals, Int64Type)
+}
+
+func (s *SchemaRegisterTS) TestRegisterSearchPath(c *check.C) {
+	Configure(Configuration{SearchPath: []string{`t_audit`, `public`}})
+	c.Assert(Register(`t_users`), check.IsNil)
+	c.Assert(Register(`t_roles`), check.IsNil)
+
+	c.Assert(defaultMapper.registry.load()[`t_audit.t_users.id`], check.Equals, Int64Type)
+	c.Assert(defaultMapper.registry.load()[`public.t_roles.id`], check.Equals, StringType)
+
+	exec(`INSERT INTO t_audit.t_users (id, action, created_at) VALUES ($1, $2, $3)`, 1, `login`, testTime)
+	data, err := Select(`t_users.id`, `t_users.action`).From(`t_users`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_users.id`], check.Equals, int64(1))
+	c.Assert(data[0][`t_users.action`], check.Equals, `login`)
+}
+
+func (s *SchemaRegisterTS) TestRegisterUnknownTable(c *check.C) {
+	c.Assert(Register(`t_nothing`), check.ErrorMatches, `cannot load schema, table "t_nothing" has no columns or does not exist`)
+	// the name is a parameter of the schema query, not a part of it
+	c.Assert(Register(`t_users' OR table_name = 't_roles`), check.ErrorMatches, `cannot load schema, table .* has no columns or does not exist`)
+}
+
+func (s *SchemaTS) TestColumnType(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{
+		`public.t_users.id`:      StringType,
+		`t_audit.t_users.id`:     Int64Type,
+		`t_audit.t_users.action`: StringType,
+	})
+
+	var tests = []struct {
+		tables  []tableName
+		field   string
+		colType int
+		ok      bool
+	}{
+		{nil, `t_users.id`, StringType, true},
+		{nil, `t_audit.t_users.id`, Int64Type, true},
+		{[]tableName{{schema: `t_audit`, name: `t_users`}}, `t_users.id`, Int64Type, true},
+		{[]tableName{{schema: `t_audit`, name: `t_users`}}, `action`, StringType, true},
+		{[]tableName{{name: `t_users`}}, `t_users.action`, invalidType, false},
+		{nil, `t_roles.id`, invalidType, false},
+	}
+	for _, test := range tests {
+		colType, ok := m.columnType(test.tables, test.field)
+		c.Assert(ok, check.Equals, test.ok)
+		c.Assert(colType, check.Equals, test.colType)
+	}
+}
+
+func (s *SchemaTS) TestResolveTable(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{
+		`public.t_users.id`:      StringType,
+		`public.t_roles.id`:      StringType,
+		`t_audit.t_users.id`:     Int64Type,
+		`t_audit.t_users.action`: StringType,
+	})
+
+	// postgres and the registry both default to public
+	c.Assert(m.Select(`t_users.id`).From(`t_users`).sql(), check.Equals, `SELECT "t_users"."id" FROM "t_users"`)
+
+	m.Configure(Configuration{SearchPath: []string{`t_audit`, `public`}})
+	q := m.Select(`t_users.id`, `t_users.action`).From(`t_users`).Join(InnerJoin, `t_roles`, `t_roles.id = t_users.action`)
+	c.Assert(q.sql(), check.Equals, `SELECT "t_users"."id", "t_users"."action" FROM "t_audit"."t_users" INNER JOIN "public"."t_roles" ON t_roles.id = t_users.action`)
+	c.Assert(m.checkQuery(q), check.IsNil)
+
+	c.Assert(m.Insert(`t_users`, `id, action`, 1, `login`).sql(), check.Equals, `INSERT INTO "t_audit"."t_users" ("id", "action") VALUES ($1, $2)`)
+	c.Assert(m.Update(`t_users`, `action = ?`, `logout`).sql(), check.Equals, `UPDATE "t_audit"."t_users" SET action = $1`)
+	c.Assert(m.Delete(`public.t_users`).sql(), check.Equals, `DELETE FROM "public"."t_users"`)
+	c.Assert(m.Truncate(`t_users`, `t_places`).sql(), check.Equals, `TRUNCATE "t_audit"."t_users", "t_places"`)
+}
+
 var toTypeTests = []struct {
 	dataType, nullable string
 	out                interface{}
 }{
-	{`character varying`, `NO`, stringType},
-	{`character varying`, `YES`, nullStringType},
-	{`text`, `NO`, stringType},
-	{`text`, `YES`, nullStringType},
-	{`integer`, `NO`, int64Type},
-	{`integer`, `YES`, nullInt64Type},
-	{`boolean`, `NO`, boolType},
-	{`boolean`, `YES`, nullBoolType},
-	{`timestamp with time zone`, `NO`, timeType},
-	{`timestamp with time zone`, `YES`, nullTimeType},
-	{`timestamp without time zone`, `NO`, timeType},
-	{`timestamp without time zone`, `YES`, nullTimeType},
-	{`random`, `YES`, `invalid sql data type, got "random", expected one of ("character varying", "text", "integer", "boolean", "timestamp with time zone", "timestamp without time zone")`},
+	{`character varying`, `NO`, StringType},
+	{`character varying`, `YES`, NullStringType},
+	{`text`, `NO`, StringType},
+	{`text`, `YES`, NullStringType},
+	{`integer`, `NO`, Int64Type},
+	{`integer`, `YES`, NullInt64Type},
+	{`boolean`, `NO`, BoolType},
+	{`boolean`, `YES`, NullBoolType},
+	{`timestamp with time zone`, `NO`, TimeType},
+	{`timestamp with time zone`, `YES`, NullTimeType},
+	{`timestamp without time zone`, `NO`, TimeType},
+	{`timestamp without time zone`, `YES`, NullTimeType},
+	{`character`, `NO`, StringType},
+	{`uuid`, `NO`, StringType},
+	{`uuid`, `YES`, NullStringType},
+	{`smallint`, `NO`, Int64Type},
+	{`smallint`, `YES`, NullInt64Type},
+	{`bigint`, `NO`, Int64Type},
+	{`bigint`, `YES`, NullInt64Type},
+	{`real`, `NO`, Float64Type},
+	{`real`, `YES`, NullFloat64Type},
+	{`double precision`, `NO`, Float64Type},
+	{`double precision`, `YES`, NullFloat64Type},
+	{`numeric`, `NO`, NumericType},
+	{`numeric`, `YES`, NullNumericType},
+	{`date`, `NO`, TimeType},
+	{`date`, `YES`, NullTimeType},
+	{`bytea`, `NO`, BytesType},
+	{`bytea`, `YES`, NullBytesType},
+	{`json`, `NO`, JSONType},
+	{`json`, `YES`, NullJSONType},
+	{`jsonb`, `NO`, JSONType},
+	{`jsonb`, `YES`, NullJSONType},
+	{`random`, `YES`, `invalid sql data type, got "random", expected one of ("character varying", "character", "text", "inet", "uuid", "smallint", "integer", "bigint", "real", "double precision", "numeric", "boolean", "date", "timestamp with time zone", "timestamp without time zone", "bytea", "json", "jsonb")`},
 	{`character varying`, `yes`, `invalid value for nullable, got "yes", expected one of ("YES", "NO")`},
 }
 
-func (s *SchemaTS) TestToType(c *C) {
+func (s *SchemaTS) TestToType(c *check.C) {
 	for _, test := range toTypeTests {
 		golangType, err := toType(test.dataType, test.nullable)
 		if err != nil {
-			c.Assert(err.Error(), Equals, test.out.(string))
+			c.Assert(err.Error(), check.Equals, test.out.(string))
+		} else {
+			c.Assert(golangType, check.Equals, test.out.(int))
+		}
+	}
+}
+
+var toArrayTypeTests = []struct {
+	udtName, nullable string
+	out               interface{}
+}{
+	{`_text`, `NO`, StringArrayType},
+	{`_varchar`, `YES`, StringArrayType},
+	{`_uuid`, `NO`, StringArrayType},
+	{`_int4`, `NO`, Int64ArrayType},
+	{`_int8`, `YES`, Int64ArrayType},
+	{`_float8`, `NO`, Float64ArrayType},
+	{`_bool`, `NO`, BoolArrayType},
+	{`_jsonb`, `NO`, `invalid sql array type, got "_jsonb", expected an array of one of ("character varying", "character", "text", "uuid", "smallint", "integer", "bigint", "real", "double precision", "boolean")`},
+	{`_text`, `no`, `invalid value for nullable, got "no", expected one of ("YES", "NO")`},
+}
+
+func (s *SchemaTS) TestToArrayType(c *check.C) {
+	for _, test := range toArrayTypeTests {
+		golangType, err := toArrayType(test.udtName, test.nullable)
+		if err != nil {
+			c.Assert(err.Error(), check.Equals, test.out.(string))
 		} else {
-			c.Assert(golangType, Equals, test.out.(int))
+			c.Assert(golangType, check.Equals, test.out.(int))
 		}
 	}
 }
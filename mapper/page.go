@@ -0,0 +1,156 @@
+package mapper
+
+import (
+	`bytes`
+	`database/sql/driver`
+	`encoding/base64`
+	`encoding/json`
+	`fmt`
+	`strings`
+)
+
+var (
+	offsetTemplate     = `%s OFFSET %d`
+	rowCompareTemplate = `(%s) %s (%s)`
+	compareTemplate    = `%s %s ?`
+)
+
+const (
+	noOrderErr     = `keyset pagination needs the query to be ordered, call Order before After`
+	badCursorErr   = `invalid cursor %q, err=%v`
+	cursorSizeErr  = `cursor has %d values, but the query is ordered by %d fields`
+	cursorFieldErr = `order field %s is not in the records, it must be selected to make a cursor`
+	cursorExprErr  = `order field %s is a computed expression, a cursor can only compare columns`
+)
+
+// Offset skips the first n rows, prefer After for deep pages: the skipped rows are still read
+func (q *Query) Offset(n int) *Query {
+	q.tail = fmt.Sprintf(offsetTemplate, q.tail, n)
+	return q
+}
+
+// After makes the query return the rows following the cursor, which comes from NextCursor
+// on the previous page. It's keyset pagination: the order fields of the last row are compared,
+// so it must be called after Order, and the order fields should identify a row (end with the primary key)
+// and not be NULL. Aliased columns can be ordered by, computed expressions can't. An empty cursor is the first page
+func (q *Query) After(cursor string) *Query {
+	if len(q.orders) == 0 {
+		q.setErr(fmt.Errorf(noOrderErr))
+		return q
+	}
+	for _, o := range q.orders {
+		if _, ok := q.exprTypes[o.field]; ok {
+			q.setErr(fmt.Errorf(cursorExprErr, o.field))
+			return q
+		}
+	}
+	if cursor == `` {
+		return q
+	}
+
+	values, err := decodeCursor(cursor)
+	if err != nil {
+		q.setErr(err)
+		return q
+	}
+	if len(values) != len(q.orders) {
+		q.setErr(fmt.Errorf(cursorSizeErr, len(values), len(q.orders)))
+		return q
+	}
+	return q.Where(q.keysetPredicate(values))
+}
+
+// keysetPredicate is (a, b) > (?, ?) when all fields are sorted the same way,
+// otherwise a > ? OR (a = ? AND b < ?), etc
+// Aliases are replaced by their columns, WHERE doesn't see the aliases of the select
+func (q *Query) keysetPredicate(values []interface{}) Predicate {
+	sameWay := true
+	columns := make([]string, 0, len(q.orders))
+	for _, o := range q.orders {
+		sameWay = sameWay && o.orderType == q.orders[0].orderType
+		column := o.field
+		if aliased, ok := q.aliases[o.field]; ok {
+			column = aliased
+		}
+		columns = append(columns, column)
+	}
+
+	if sameWay {
+		fields := make([]string, 0, len(columns))
+		for _, column := range columns {
+			fields = append(fields, quoteIdentifier(column))
+		}
+		marks := strings.TrimSuffix(strings.Repeat(placeHolder+`, `, len(values)), `, `)
+		text := fmt.Sprintf(rowCompareTemplate, strings.Join(fields, `, `), comparison(q.orders[0].orderType), marks)
+		return Raw(text, values...)
+	}
+
+	alternatives := make([]Predicate, 0, len(q.orders))
+	for i, o := range q.orders {
+		conditions := make([]Predicate, 0, i+1)
+		for j := 0; j < i; j++ {
+			conditions = append(conditions, Eq(columns[j], values[j]))
+		}
+		conditions = append(conditions, Predicate{text: fmt.Sprintf(compareTemplate, quoteIdentifier(columns[i]), comparison(o.orderType)), args: []interface{}{values[i]}})
+		alternatives = append(alternatives, And(conditions...))
+	}
+	return Or(alternatives...)
+}
+
+// comparison gives the operator selecting the rows after a value
+func comparison(orderType int) string {
+	if orderType == Desc {
+		return `<`
+	}
+	return `>`
+}
+
+// NextCursor gives the cursor of the page following records, to be given to After.
+// It's empty when there's no next page: no records, or less of them than the limit
+func (q *Query) NextCursor(records []Record) (string, error) {
+	if len(q.orders) == 0 {
+		return ``, fmt.Errorf(noOrderErr)
+	}
+	if len(records) == 0 || (q.limit > 0 && len(records) < q.limit) {
+		return ``, nil
+	}
+
+	last := records[len(records)-1]
+	values := make([]interface{}, 0, len(q.orders))
+	for _, o := range q.orders {
+		value, ok := last[o.field]
+		if !ok {
+			return ``, fmt.Errorf(cursorFieldErr, o.field)
+		}
+		// sql.NullString etc are sent as their value
+		if valuer, ok := value.(driver.Valuer); ok {
+			var err error
+			if value, err = valuer.Value(); err != nil {
+				return ``, err
+			}
+		}
+		values = append(values, value)
+	}
+
+	raw, err := json.Marshal(values)
+	if err != nil {
+		return ``, err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// decodeCursor gives back the values of a cursor, numbers are kept as json.Number (sent as text) to not lose precision
+func decodeCursor(cursor string) ([]interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf(badCursorErr, cursor, err)
+	}
+
+	var values []interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&values); err != nil {
+		return nil, fmt.Errorf(badCursorErr, cursor, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,143 @@
+package mapper
+
+import (
+	`database/sql`
+	`encoding/json`
+	`gopkg.in/check.v1`
+)
+
+type PageTS struct{}
+
+type PageExecTS struct{}
+
+func init() {
+	check.Suite(&PageTS{})
+	check.Suite(&PageExecTS{})
+}
+
+func (s *PageTS) TestOffset(c *check.C) {
+	testQuery(c,
+		Select(`t_users.id`).From(`t_users`).Order(`t_users.id`, Asc).Limit(10).Offset(20),
+		SelectQuery,
+		`SELECT "t_users"."id" FROM "t_users" ORDER BY "t_users"."id" ASC LIMIT 10 OFFSET 20`,
+		[]string{`t_users.id`},
+		nil,
+	)
+}
+
+func (s *PageTS) TestCursorRoundTrip(c *check.C) {
+	q := Select(`t_users.created_at`, `t_users.id`).From(`t_users`).Order(`t_users.created_at`, Desc).Order(`t_users.id`, Desc).Limit(2)
+	cursor, err := q.NextCursor([]Record{
+		{`t_users.created_at`: testTime, `t_users.id`: `1u`},
+		{`t_users.created_at`: testTime, `t_users.id`: `2u`},
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(cursor, check.Not(check.Equals), ``)
+
+	values, err := decodeCursor(cursor)
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, []interface{}{`2014-06-18T09:00:00Z`, `2u`})
+
+	// the last page
+	cursor, err = q.NextCursor([]Record{{`t_users.created_at`: testTime, `t_users.id`: `1u`}})
+	c.Assert(err, check.IsNil)
+	c.Assert(cursor, check.Equals, ``)
+
+	// nullable values are stored as their value, numbers don't lose precision
+	q = Select(`t_users.email`, `t_items.id`).From(`t_users`).Order(`t_users.email`, Asc).Order(`t_items.id`, Asc)
+	cursor, err = q.NextCursor([]Record{{`t_users.email`: sql.NullString{Valid: true, String: `a@b.com`}, `t_items.id`: int64(9007199254740993)}})
+	c.Assert(err, check.IsNil)
+	values, err = decodeCursor(cursor)
+	c.Assert(err, check.IsNil)
+	c.Assert(values, check.DeepEquals, []interface{}{`a@b.com`, json.Number(`9007199254740993`)})
+}
+
+func (s *PageTS) TestAfter(c *check.C) {
+	cursor, _ := Select(`t_users.age`, `t_users.id`).From(`t_users`).Order(`t_users.age`, Asc).Order(`t_users.id`, Asc).
+		NextCursor([]Record{{`t_users.age`: int64(20), `t_users.id`: `1u`}})
+
+	testQuery(c,
+		Select(`t_users.id`).From(`t_users`).Where(`t_users.active = ?`, true).Order(`t_users.age`, Asc).Order(`t_users.id`, Asc).After(cursor).Limit(10),
+		SelectQuery,
+		`SELECT "t_users"."id" FROM "t_users" WHERE (t_users.active = $1) AND (("t_users"."age", "t_users"."id") > ($2, $3)) ORDER BY "t_users"."age" ASC, "t_users"."id" ASC LIMIT 10`,
+		[]string{`t_users.id`},
+		[]interface{}{true, json.Number(`20`), `1u`},
+	)
+
+	testQuery(c,
+		Select(`t_users.id`).From(`t_users`).Order(`t_users.age`, Desc).Order(`t_users.id`, Asc).After(cursor),
+		SelectQuery,
+		`SELECT "t_users"."id" FROM "t_users" WHERE "t_users"."age" < $1 OR ("t_users"."age" = $2 AND "t_users"."id" > $3) ORDER BY "t_users"."age" DESC, "t_users"."id" ASC`,
+		[]string{`t_users.id`},
+		[]interface{}{json.Number(`20`), json.Number(`20`), `1u`},
+	)
+
+	// aliases are compared by their columns
+	mailCursor, _ := SelectExpr(As(`t_users.email`, `mail`), Column(`t_users.id`)).From(`t_users`).Order(`mail`, Asc).Order(`t_users.id`, Asc).
+		NextCursor([]Record{{`mail`: `a@b.com`, `t_users.id`: `1u`}})
+	testQuery(c,
+		SelectExpr(As(`t_users.email`, `mail`), Column(`t_users.id`)).From(`t_users`).Order(`mail`, Asc).Order(`t_users.id`, Asc).After(mailCursor),
+		SelectQuery,
+		`SELECT "t_users"."email" AS "mail", "t_users"."id" FROM "t_users" WHERE ("t_users"."email", "t_users"."id") > ($1, $2) ORDER BY "mail" ASC, "t_users"."id" ASC`,
+		[]string{`mail`, `t_users.id`},
+		[]interface{}{`a@b.com`, `1u`},
+	)
+	testQuery(c,
+		SelectExpr(As(`t_users.email`, `mail`), Column(`t_users.id`)).From(`t_users`).Order(`mail`, Desc).Order(`t_users.id`, Asc).After(mailCursor),
+		SelectQuery,
+		`SELECT "t_users"."email" AS "mail", "t_users"."id" FROM "t_users" WHERE "t_users"."email" < $1 OR ("t_users"."email" = $2 AND "t_users"."id" > $3) ORDER BY "mail" DESC, "t_users"."id" ASC`,
+		[]string{`mail`, `t_users.id`},
+		[]interface{}{`a@b.com`, `a@b.com`, `1u`},
+	)
+
+	// the first page
+	q := Select(`t_users.id`).From(`t_users`).Order(`t_users.id`, Asc).After(``)
+	c.Assert(q.err, check.IsNil)
+	c.Assert(q.where, check.HasLen, 0)
+}
+
+func (s *PageTS) TestCursorErrors(c *check.C) {
+	c.Assert(Select(`t_users.id`).From(`t_users`).After(`x`).err, check.ErrorMatches, `keyset pagination needs the query to be ordered.*`)
+	c.Assert(Select(`t_users.id`).From(`t_users`).Order(`t_users.id`, Asc).After(`!!`).err, check.ErrorMatches, `invalid cursor.*`)
+
+	cursor, _ := Select(`t_users.id`).From(`t_users`).Order(`t_users.id`, Asc).NextCursor([]Record{{`t_users.id`: `1u`}})
+	q := Select(`t_users.id`).From(`t_users`).Order(`t_users.age`, Asc).Order(`t_users.id`, Asc).After(cursor)
+	c.Assert(q.err, check.ErrorMatches, `cursor has 1 values, but the query is ordered by 2 fields`)
+
+	q = SelectExpr(Count(`*`).As(`total`)).From(`t_users`).GroupBy(`t_users.age`).Order(`total`, Asc).After(``)
+	c.Assert(q.err, check.ErrorMatches, `order field total is a computed expression, a cursor can only compare columns`)
+
+	_, err := Select(`t_users.id`).From(`t_users`).Order(`t_users.age`, Asc).NextCursor([]Record{{`t_users.id`: `1u`}})
+	c.Assert(err, check.ErrorMatches, `order field t_users.age is not in the records.*`)
+}
+
+func (s *PageExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+	for _, id := range []string{`1u`, `2u`, `3u`, `4u`, `5u`} {
+		exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, id, nil, 20, false, false, 0, nil, testTime)
+	}
+}
+
+func (s *PageExecTS) TestKeysetPages(c *check.C) {
+	var ids []string
+	cursor := ``
+	for page := 0; page < 5; page++ {
+		q := Select(`t_users.age`, `t_users.id`).From(`t_users`).Order(`t_users.age`, Desc).Order(`t_users.id`, Asc).After(cursor).Limit(2)
+		data, err := q.Run()
+		c.Assert(err, check.IsNil)
+		for _, record := range data {
+			ids = append(ids, record[`t_users.id`].(string))
+		}
+		if cursor, err = q.NextCursor(data); err != nil || cursor == `` {
+			c.Assert(err, check.IsNil)
+			break
+		}
+	}
+	c.Assert(ids, check.DeepEquals, []string{`1u`, `2u`, `3u`, `4u`, `5u`})
+
+	data, err := Select(`t_users.id`).From(`t_users`).Order(`t_users.id`, Desc).Limit(2).Offset(1).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(data[0][`t_users.id`], check.Equals, `4u`)
+	c.Assert(data[1][`t_users.id`], check.Equals, `3u`)
+}
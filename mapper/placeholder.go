@@ -0,0 +1,188 @@
+package mapper
+
+import (
+	`fmt`
+	`strconv`
+	`strings`
+)
+
+var (
+	subQueryTemplate = `(%s)`
+)
+
+const (
+	placeHolder        = `?`
+	escapedPlaceHolder = `??`
+
+	bulkSubQueryErr     = `a bulk insert cannot be used as a subquery`
+	placeHolderCountErr = `%d place holders for %d args in %q`
+)
+
+// bindArgs replaces the `?` in text with $start, $start+1, ... and returns the args in that order
+// A *Query arg is put in the text instead, in (), with its own $n place holders renumbered to follow, and its args added
+// There must be exactly 1 place holder per arg, `??` is a literal `?` (like the jsonb operator)
+func bindArgs(text string, start int, args []interface{}) (string, []interface{}, []*Query, error) {
+	parts := splitPlaceholders(text)
+	if len(parts)-1 != len(args) {
+		return ``, nil, nil, fmt.Errorf(placeHolderCountErr, len(parts)-1, len(args), text)
+	}
+
+	final := make([]string, 0, len(parts)*2)
+	bound := make([]interface{}, 0, len(args))
+	var subQueries []*Query
+	for offset, part := range parts {
+		final = append(final, part)
+		if offset == len(parts)-1 {
+			break
+		}
+
+		sub, ok := args[offset].(*Query)
+		if !ok {
+			final = append(final, fmt.Sprintf(argTemplate, start+len(bound)))
+			bound = append(bound, args[offset])
+			continue
+		}
+		if sub.err != nil {
+			return ``, nil, nil, sub.err
+		}
+		if sub.queryType == BulkInsertQuery {
+			return ``, nil, nil, fmt.Errorf(bulkSubQueryErr)
+		}
+		final = append(final, fmt.Sprintf(subQueryTemplate, renumberPlaceholders(sub.sql(), start+len(bound)-1)))
+		bound = append(bound, sub.args...)
+		subQueries = append(subQueries, sub)
+	}
+	return strings.Join(final, ``), bound, subQueries, nil
+}
+
+// splitPlaceholders splits text around its `?` place holders, `??` are made `?`
+// Quoted strings and identifiers, dollar quoted strings and comments are left alone
+func splitPlaceholders(text string) []string {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if end := skipLiteral(text, i); end > i {
+			b.WriteString(text[i:end])
+			i = end - 1
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text[i:], escapedPlaceHolder):
+			b.WriteString(placeHolder)
+			i++
+		case strings.HasPrefix(text[i:], placeHolder):
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return append(parts, b.String())
+}
+
+// renumberPlaceholders adds offset to the $n place holders of a statement
+// Quoted strings and identifiers, dollar quoted strings and comments are left alone
+func renumberPlaceholders(statement string, offset int) string {
+	if offset == 0 {
+		return statement
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(statement); i++ {
+		if end := skipLiteral(statement, i); end > i {
+			b.WriteString(statement[i:end])
+			i = end - 1
+			continue
+		}
+		if statement[i] == '$' && i+1 < len(statement) && isDigit(statement[i+1]) {
+			end := i + 1
+			for end < len(statement) && isDigit(statement[end]) {
+				end++
+			}
+			n, _ := strconv.Atoi(statement[i+1 : end])
+			b.WriteString(fmt.Sprintf(argTemplate, n+offset))
+			i = end - 1
+			continue
+		}
+		b.WriteByte(statement[i])
+	}
+	return b.String()
+}
+
+// skipLiteral gives the end of the string, quoted identifier or comment starting at i, or i if there's none
+// An unterminated one runs to the end of the text
+func skipLiteral(text string, i int) int {
+	rest := text[i:]
+	var end int
+	switch {
+	case (rest[0] == 'E' || rest[0] == 'e') && strings.HasPrefix(rest[1:], `'`) && (i == 0 || !isWordChar(text[i-1])):
+		// E'it\'s' is an escape string, a backslash escapes the quote
+		if end = escapeStringEnd(rest[2:]); end >= 0 {
+			end += 2
+		}
+	case rest[0] == '\'' || rest[0] == '"':
+		// a doubled quote inside ('it''s') ends it and starts it again, which gives the same end
+		if end = strings.IndexByte(rest[1:], rest[0]); end >= 0 {
+			end += 2
+		}
+	case strings.HasPrefix(rest, `--`):
+		end = strings.IndexByte(rest, '\n') + 1
+	case strings.HasPrefix(rest, `/*`):
+		if end = strings.Index(rest[2:], `*/`); end >= 0 {
+			end += 4
+		}
+	case rest[0] == '$':
+		tag := dollarTag(rest)
+		if tag == `` {
+			return i
+		}
+		if end = strings.Index(rest[len(tag):], tag); end >= 0 {
+			end += 2 * len(tag)
+		}
+	default:
+		return i
+	}
+	if end <= 0 {
+		return len(text)
+	}
+	return i + end
+}
+
+// escapeStringEnd gives the end of the content of an escape string, after its closing quote, or -1 if there's none
+func escapeStringEnd(text string) int {
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case text[i] == '\'' && strings.HasPrefix(text[i+1:], `'`):
+			i++
+		case text[i] == '\'':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// dollarTag gives the $tag$ opening a dollar quoted string at the start of text, or ""
+func dollarTag(text string) string {
+	for i := 1; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case ch == '$':
+			return text[:i+1]
+		case ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || i > 1 && isDigit(ch):
+		default:
+			return ``
+		}
+	}
+	return ``
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// isWordChar tells if ch can be part of a keyword or an unquoted identifier
+func isWordChar(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || isDigit(ch)
+}
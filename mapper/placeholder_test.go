@@ -0,0 +1,77 @@
+package mapper
+
+import (
+	`gopkg.in/check.v1`
+)
+
+type PlaceholderTS struct{}
+
+func init() {
+	check.Suite(&PlaceholderTS{})
+}
+
+func (s *PlaceholderTS) TestBindArgs(c *check.C) {
+	var tests = []struct {
+		in   string
+		args []interface{}
+		out  string
+	}{
+		{`a = ? AND b = ?`, []interface{}{1, 2}, `a = $3 AND b = $4`},
+		{`a = '?' AND b = ?`, []interface{}{1}, `a = '?' AND b = $3`},
+		{`a = 'it''s ?' AND "b?" = ?`, []interface{}{1}, `a = 'it''s ?' AND "b?" = $3`},
+		{`data ?? 'kind' AND b = ?`, []interface{}{1}, `data ? 'kind' AND b = $3`},
+		{`data ??| ? AND b`, []interface{}{[]string{`a`}}, `data ?| $3 AND b`},
+		{"a = ? -- why?\n", []interface{}{1}, "a = $3 -- why?\n"},
+		{`a = ? /* b = ? */`, []interface{}{1}, `a = $3 /* b = ? */`},
+		{`a = $$?$$ AND b = $x$ ? $x$ AND c = ?`, []interface{}{1}, `a = $$?$$ AND b = $x$ ? $x$ AND c = $3`},
+		{`a = '?`, nil, `a = '?`},
+		{`name = E'it\'s ?' AND id = ?`, []interface{}{1}, `name = E'it\'s ?' AND id = $3`},
+		{`name = e'\\\\' AND id = ? AND b = E'?''?'`, []interface{}{1}, `name = e'\\\\' AND id = $3 AND b = E'?''?'`},
+		{`TYPE'?' = ?`, []interface{}{1}, `TYPE'?' = $3`},
+		{`a = E'?`, nil, `a = E'?`},
+	}
+	for _, test := range tests {
+		text, args, _, err := bindArgs(test.in, 3, test.args)
+		c.Assert(err, check.IsNil)
+		c.Assert(text, check.Equals, test.out)
+		c.Assert(len(args), check.Equals, len(test.args))
+	}
+}
+
+func (s *PlaceholderTS) TestBindArgsCount(c *check.C) {
+	_, _, _, err := bindArgs(`a = ? AND b = ?`, 1, []interface{}{1})
+	c.Assert(err, check.ErrorMatches, `2 place holders for 1 args in "a = \? AND b = \?"`)
+	_, _, _, err = bindArgs(`data ? 'kind'`, 1, nil)
+	c.Assert(err, check.ErrorMatches, `1 place holders for 0 args .*`)
+
+	c.Assert(Select(`t_users.id`).From(`t_users`).Where(`t_users.age > ?`).err, check.ErrorMatches, `1 place holders for 0 args .*`)
+	c.Assert(Update(`t_users`, `age = ?`, 1, 2).err, check.ErrorMatches, `1 place holders for 2 args .*`)
+
+	testQuery(c,
+		Update(`t_events`, `meta = ?`, `{}`).Where(`t_events.data ?? ?`, `kind`),
+		UpdateQuery,
+		`UPDATE "t_events" SET meta = $1 WHERE t_events.data ? $2`,
+		nil,
+		[]interface{}{`{}`, `kind`},
+	)
+}
+
+func (s *PlaceholderTS) TestRenumberPlaceholders(c *check.C) {
+	var tests = []struct {
+		in     string
+		offset int
+		out    string
+	}{
+		{`SELECT 1 WHERE a = $1 AND b = $2`, 0, `SELECT 1 WHERE a = $1 AND b = $2`},
+		{`SELECT 1 WHERE a = $1 AND b = $2`, 2, `SELECT 1 WHERE a = $3 AND b = $4`},
+		{`SELECT 1 WHERE a = $10`, 1, `SELECT 1 WHERE a = $11`},
+		{`SELECT '$1', "$2" WHERE a = $1`, 3, `SELECT '$1', "$2" WHERE a = $4`},
+		{`SELECT $ WHERE a = $1`, 1, `SELECT $ WHERE a = $2`},
+		{"SELECT 1 -- $1\nWHERE a = $1 /* $2 */", 1, "SELECT 1 -- $1\nWHERE a = $2 /* $2 */"},
+		{`SELECT $tag$ $1 $tag$ WHERE a = $1`, 1, `SELECT $tag$ $1 $tag$ WHERE a = $2`},
+		{`SELECT E'\'$1' WHERE a = $1`, 1, `SELECT E'\'$1' WHERE a = $2`},
+	}
+	for _, test := range tests {
+		c.Assert(renumberPlaceholders(test.in, test.offset), check.Equals, test.out)
+	}
+}
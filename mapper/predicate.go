@@ -0,0 +1,141 @@
+package mapper
+
+import (
+	`fmt`
+	`reflect`
+	`strings`
+)
+
+var (
+	eqTemplate      = `%s = ?`
+	inTemplate      = `%s IN (%s)`
+	likeTemplate    = `%s LIKE ?`
+	betweenTemplate = `%s BETWEEN ? AND ?`
+	isNullTemplate  = `%s IS NULL`
+	inQueryTemplate = `%s IN ?`
+	existsTemplate  = `EXISTS ?`
+	notTemplate     = `NOT %s`
+	groupTemplate   = `(%s)`
+)
+
+const (
+	andWord   = ` AND `
+	orWord    = ` OR `
+	trueWord  = `true`
+	falseWord = `false`
+)
+
+// Predicate is a condition of a where clause, built with Eq, In, And, Or, etc and negated with Not
+// It uses ? for place holders, they become $n when given to Where
+// Fields are quoted, and must be registered columns for the query to run
+type Predicate struct {
+	text     string
+	args     []interface{}
+	fields   []string
+	compound bool // made of several conditions, grouped in () when put inside another one
+}
+
+// Raw makes a predicate of a condition string, like the ones given to Where
+func Raw(condition string, args ...interface{}) Predicate {
+	return Predicate{text: condition, args: args, compound: true}
+}
+
+// Eq is field = value
+func Eq(field string, value interface{}) Predicate {
+	return Predicate{text: fmt.Sprintf(eqTemplate, quoteIdentifier(field)), args: []interface{}{value}, fields: []string{field}}
+}
+
+// In is field IN (values...). A single slice is expanded into its elements,
+// so In(`id`, ids) and In(`id`, 1, 2, 3) both work. An empty list matches nothing
+// A single *Query is used as a subquery: In(`t_users.id`, Select(`t_user_roles.user_id`).From(`t_user_roles`))
+func In(field string, values ...interface{}) Predicate {
+	if len(values) == 1 {
+		if _, ok := values[0].(*Query); ok {
+			return Predicate{text: fmt.Sprintf(inQueryTemplate, quoteIdentifier(field)), args: values, fields: []string{field}}
+		}
+		values = expandSlice(values[0])
+	}
+	if len(values) == 0 {
+		return Predicate{text: falseWord, fields: []string{field}}
+	}
+	marks := strings.TrimSuffix(strings.Repeat(placeHolder+`, `, len(values)), `, `)
+	return Predicate{text: fmt.Sprintf(inTemplate, quoteIdentifier(field), marks), args: values, fields: []string{field}}
+}
+
+// expandSlice gives the elements of a slice (but not []byte, which is a single bytea value)
+func expandSlice(value interface{}) []interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+		return []interface{}{value}
+	}
+	values := make([]interface{}, v.Len())
+	for i := range values {
+		values[i] = v.Index(i).Interface()
+	}
+	return values
+}
+
+// Like is field LIKE pattern
+func Like(field, pattern string) Predicate {
+	return Predicate{text: fmt.Sprintf(likeTemplate, quoteIdentifier(field)), args: []interface{}{pattern}, fields: []string{field}}
+}
+
+// Between is field BETWEEN low AND high, both ends included
+func Between(field string, low, high interface{}) Predicate {
+	return Predicate{text: fmt.Sprintf(betweenTemplate, quoteIdentifier(field)), args: []interface{}{low, high}, fields: []string{field}}
+}
+
+// Exists is true when the subquery returns rows, it's usually correlated to the outer query with a raw Where:
+// Exists(Select(`t_user_roles.id`).From(`t_user_roles`).Where(`t_user_roles.user_id = t_users.id`))
+func Exists(sub *Query) Predicate {
+	return Predicate{text: existsTemplate, args: []interface{}{sub}}
+}
+
+// IsNull is field IS NULL, use Not(IsNull(field)) for the opposite
+func IsNull(field string) Predicate {
+	return Predicate{text: fmt.Sprintf(isNullTemplate, quoteIdentifier(field)), fields: []string{field}}
+}
+
+// And is true when all the predicates are, it's true when there's none
+// so filters can be collected in a slice and given as And(filters...)
+func And(predicates ...Predicate) Predicate {
+	return joinPredicates(predicates, andWord, trueWord)
+}
+
+// Or is true when any of the predicates is, it's false when there's none
+func Or(predicates ...Predicate) Predicate {
+	return joinPredicates(predicates, orWord, falseWord)
+}
+
+// Not negates the predicate: Not(IsNull(`email`))
+func Not(p Predicate) Predicate {
+	return Predicate{text: fmt.Sprintf(notTemplate, fmt.Sprintf(groupTemplate, p.text)), args: p.args, fields: p.fields}
+}
+
+// joinPredicates combines predicates with AND / OR, a single one is left as it is
+func joinPredicates(predicates []Predicate, word, empty string) Predicate {
+	switch len(predicates) {
+	case 0:
+		return Predicate{text: empty}
+	case 1:
+		return predicates[0]
+	}
+
+	texts := make([]string, 0, len(predicates))
+	var args []interface{}
+	var fields []string
+	for _, p := range predicates {
+		texts = append(texts, p.grouped())
+		args = append(args, p.args...)
+		fields = append(fields, p.fields...)
+	}
+	return Predicate{text: strings.Join(texts, word), args: args, fields: fields, compound: true}
+}
+
+// grouped gives the text of the predicate, in () when it's made of several conditions
+func (p Predicate) grouped() string {
+	if p.compound {
+		return fmt.Sprintf(groupTemplate, p.text)
+	}
+	return p.text
+}
@@ -0,0 +1,105 @@
+package mapper
+
+import (
+	`database/sql`
+	. `github.com/viki-org/gomods/sqlcheckers`
+	`gopkg.in/check.v1`
+)
+
+type PredicateTS struct{}
+
+type PredicateExecTS struct{}
+
+func init() {
+	check.Suite(&PredicateTS{})
+	check.Suite(&PredicateExecTS{})
+}
+
+func (s *PredicateTS) TestPredicates(c *check.C) {
+	var tests = []struct {
+		p    Predicate
+		text string
+		args []interface{}
+	}{
+		{Eq(`t_users.id`, `1u`), `"t_users"."id" = ?`, []interface{}{`1u`}},
+		{In(`t_users.id`, `1u`, `2u`), `"t_users"."id" IN (?, ?)`, []interface{}{`1u`, `2u`}},
+		{In(`t_users.id`, []string{`1u`, `2u`, `3u`}), `"t_users"."id" IN (?, ?, ?)`, []interface{}{`1u`, `2u`, `3u`}},
+		{In(`t_users.id`, []string{}), `false`, nil},
+		{In(`t_places.data`, []byte(`x`)), `"t_places"."data" IN (?)`, []interface{}{[]byte(`x`)}},
+		{Like(`t_users.email`, `%@test.com`), `"t_users"."email" LIKE ?`, []interface{}{`%@test.com`}},
+		{Between(`t_users.age`, 18, 30), `"t_users"."age" BETWEEN ? AND ?`, []interface{}{18, 30}},
+		{IsNull(`t_users.email`), `"t_users"."email" IS NULL`, nil},
+		{Not(IsNull(`t_users.email`)), `NOT ("t_users"."email" IS NULL)`, nil},
+		{And(), `true`, nil},
+		{Or(), `false`, nil},
+		{And(Eq(`a`, 1)), `"a" = ?`, []interface{}{1}},
+		{
+			And(Eq(`a`, 1), Or(Eq(`b`, 2), IsNull(`b`)), Raw(`c > ? OR c < ?`, 3, 4)),
+			`"a" = ? AND ("b" = ? OR "b" IS NULL) AND (c > ? OR c < ?)`,
+			[]interface{}{1, 2, 3, 4},
+		},
+		{Not(Or(Eq(`a`, 1), Eq(`b`, 2))), `NOT ("a" = ? OR "b" = ?)`, []interface{}{1, 2}},
+	}
+	for _, test := range tests {
+		c.Assert(test.p.text, check.Equals, test.text)
+		c.Assert(test.p.args, check.DeepEquals, test.args)
+	}
+}
+
+func (s *PredicateTS) TestWhere(c *check.C) {
+	testQuery(c,
+		Select(`t_users.id`).From(`t_users`).Where(`t_users.age > ? OR t_users.active`, 18).AndWhere(In(`t_users.id`, []string{`1u`, `2u`})).Order(`t_users.id`, Asc),
+		SelectQuery,
+		`SELECT "t_users"."id" FROM "t_users" WHERE (t_users.age > $1 OR t_users.active) AND "t_users"."id" IN ($2, $3) ORDER BY "t_users"."id" ASC`,
+		[]string{`t_users.id`},
+		[]interface{}{18, `1u`, `2u`},
+	)
+
+	testQuery(c,
+		Update(`t_users`, `age = ?`, 30).Where(And(Eq(`id`, `1u`), Not(IsNull(`email`)))).Where(`active`).Returning(`id`),
+		UpdateQuery,
+		`UPDATE "t_users" SET age = $1 WHERE ("id" = $2 AND NOT ("email" IS NULL)) AND (active) RETURNING "id"`,
+		[]string{`id`},
+		[]interface{}{30, `1u`},
+	)
+
+	// the where clause goes before clauses added earlier, maps are stored as json
+	testQuery(c,
+		Select(`t_events.id`).From(`t_events`).Limit(1).Where(Eq(`t_events.data`, map[string]int{`a`: 1})),
+		SelectQuery,
+		`SELECT "t_events"."id" FROM "t_events" WHERE "t_events"."data" = $1 LIMIT 1`,
+		[]string{`t_events.id`},
+		[]interface{}{`{"a":1}`},
+	)
+}
+
+func (s *PredicateTS) TestWhereErrors(c *check.C) {
+	c.Assert(Select(`t_users.id`).From(`t_users`).Where(1).err, check.ErrorMatches, `where conditions must be a string or a Predicate, got int`)
+	c.Assert(Select(`t_users.id`).From(`t_users`).Where(Eq(`id`, 1), 2).err, check.ErrorMatches, `arguments of a Predicate .*`)
+}
+
+func (s *PredicateExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+	exec(sampleInsert.query, sampleInsert.args...)
+	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `1u`, nil, 20, false, false, 0, nil, testTime)
+}
+
+func (s *PredicateExecTS) TestFilters(c *check.C) {
+	var filters []Predicate
+	filters = append(filters, In(`t_users.id`, []string{`1u`, `2u`}))
+	filters = append(filters, Or(Between(`t_users.age`, 10, 30), Like(`t_users.email`, `%vader%`)))
+
+	data, err := Select(`t_users.id`).From(`t_users`).Where(And(filters...)).Order(`t_users.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 2)
+
+	data, err = Select(`t_users.id`, `t_users.email`).From(`t_users`).Where(IsNull(`t_users.email`)).AndWhere(`t_users.age < ?`, 30).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_users.email`], SQLEquals, sql.NullString{})
+
+	count, err := Delete(`t_users`).Where(Not(In(`t_users.id`, []string{}))).RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(2))
+}
@@ -2,9 +2,26 @@ package mapper
 
 // Query corresponds to an actual query to be made
 type Query struct {
-	query        string
+	mapper       *Mapper
+	query        string      // the statement up to the where clause
+	where        []Predicate // conditions of the where clause, with their $n place holders
+	groupBy      []string
+	having       []Predicate // conditions on the groups, like where
+	tail         string      // clauses after ORDER BY
+	orders       []order     // fields the rows are sorted by, in one ORDER BY
+	limit        int
 	args         []interface{}
 	selectFields []string
+	exprTypes    map[string]int    // declared types of the computed select fields, by their key in selectFields
+	aliases      map[string]string // columns renamed with As, by their alias
+	tables       []tableName       // tables the query reads from or writes to, to resolve the selected fields
+	fields       []string          // columns named in the builders (insert fields, predicates, group by, etc), checked when run
+	err          error             // first error while building the query, returned when it's run
+	bulk         *bulkInsert       // rows of a BulkInsertQuery
+	conflict     *onConflict       // ON CONFLICT clause of an insert
+	with         *CTE              // WITH clause
+	subQueries   []*Query          // queries put in this one (subqueries, WITH queries), checked with it
+	fetchSize    int               // rows read at a time through a cursor by Stream, 0 for no cursor
 	queryType    int
 }
 
@@ -0,0 +1,73 @@
+package mapper
+
+import (
+	`strings`
+	`sync`
+	`sync/atomic`
+)
+
+// registry stores the types of registered columns, keyed by schema.table.column
+// It is copy-on-write: readers (Exec, createPlaceholders) load the current maps without locking,
+// writers (Register) copy them, add their columns and swap the copy in. Registering is rare, reading is not
+type registry struct {
+	mu       sync.Mutex   // serializes writers, so that no update is lost
+	snapshot atomic.Value // *registrySnapshot, never modified once stored
+}
+
+// registrySnapshot is the content of the registry at some point
+type registrySnapshot struct {
+	columns map[string]int
+	tables  map[string]bool // schema.table of the columns
+}
+
+func newRegistry() *registry {
+	r := &registry{}
+	r.snapshot.Store(&registrySnapshot{columns: make(map[string]int, initTotalColCount), tables: map[string]bool{}})
+	return r
+}
+
+// load returns the current columns, the map must not be modified
+func (r *registry) load() map[string]int {
+	return r.snapshot.Load().(*registrySnapshot).columns
+}
+
+// hasTable tells if a schema.table has registered columns
+func (r *registry) hasTable(table string) bool {
+	return r.snapshot.Load().(*registrySnapshot).tables[table]
+}
+
+// add registers the columns of tables in one go, so readers see either none or all of them
+// The columns of a table replace all its previous ones, a table registered again after a DDL loses its dropped columns
+func (r *registry) add(newColumns map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tables := make(map[string]bool)
+	for key := range newColumns {
+		tables[columnTable(key)] = true
+	}
+
+	current := r.load()
+	next := &registrySnapshot{
+		columns: make(map[string]int, len(current)+len(newColumns)),
+		tables:  make(map[string]bool, len(tables)),
+	}
+	for key, colType := range current {
+		if table := columnTable(key); !tables[table] {
+			next.columns[key] = colType
+			next.tables[table] = true
+		}
+	}
+	for key, colType := range newColumns {
+		next.columns[key] = colType
+	}
+	for table := range tables {
+		next.tables[table] = true
+	}
+	r.snapshot.Store(next)
+}
+
+// columnTable gives the schema.table of a schema.table.column key
+func columnTable(key string) string {
+	return key[:strings.LastIndex(key, `.`)]
+}
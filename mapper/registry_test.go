@@ -0,0 +1,121 @@
+package mapper
+
+import (
+	`fmt`
+	`gopkg.in/check.v1`
+	`sync`
+)
+
+type RegistryTS struct{}
+
+type ConcurrentRegisterTS struct{}
+
+func init() {
+	check.Suite(&RegistryTS{})
+	check.Suite(&ConcurrentRegisterTS{})
+}
+
+func (s *RegistryTS) TestAdd(c *check.C) {
+	r := newRegistry()
+	before := r.load()
+
+	r.add(map[string]int{`public.t_users.id`: StringType})
+	r.add(map[string]int{`public.t_users.age`: Int64Type, `public.t_users.id`: Int64Type})
+
+	c.Assert(len(before), check.Equals, 0)
+	c.Assert(r.load(), check.DeepEquals, map[string]int{`public.t_users.id`: Int64Type, `public.t_users.age`: Int64Type})
+}
+
+func (s *RegistryTS) TestAddReplacesTable(c *check.C) {
+	r := newRegistry()
+	r.add(map[string]int{`public.t_users.id`: StringType, `public.t_users.email`: StringType, `public.t_roles.id`: StringType})
+
+	// email was dropped, and name added
+	r.add(map[string]int{`public.t_users.id`: StringType, `public.t_users.name`: NullStringType})
+	c.Assert(r.load(), check.DeepEquals, map[string]int{
+		`public.t_users.id`:   StringType,
+		`public.t_users.name`: NullStringType,
+		`public.t_roles.id`:   StringType,
+	})
+}
+
+func (s *RegistryTS) TestHasTable(c *check.C) {
+	r := newRegistry()
+	c.Assert(r.hasTable(`public.t_users`), check.Equals, false)
+
+	r.add(map[string]int{`public.t_users.id`: StringType, `audit.t_users.id`: StringType})
+	r.add(map[string]int{`public.t_roles.id`: StringType})
+	c.Assert(r.hasTable(`public.t_users`), check.Equals, true)
+	c.Assert(r.hasTable(`audit.t_users`), check.Equals, true)
+	c.Assert(r.hasTable(`public.t_roles`), check.Equals, true)
+	c.Assert(r.hasTable(`public.t_user`), check.Equals, false)
+	c.Assert(r.hasTable(`t_users`), check.Equals, false)
+}
+
+// run with -race: readers and writers must never touch the same map
+func (s *RegistryTS) TestConcurrentAddAndLookup(c *check.C) {
+	m := New(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			m.registry.add(map[string]int{fmt.Sprintf(`public.t_table%d.id`, i): Int64Type})
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.columnType(nil, fmt.Sprintf(`t_table%d.id`, j%10))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.Assert(len(m.registry.load()), check.Equals, 10)
+	for i := 0; i < 10; i++ {
+		colType, ok := m.columnType(nil, fmt.Sprintf(`t_table%d.id`, i))
+		c.Assert(ok, check.Equals, true)
+		c.Assert(colType, check.Equals, Int64Type)
+	}
+}
+
+func (s *ConcurrentRegisterTS) SetUpTest(c *check.C) {
+	createTestTables()
+	defaultMapper = New(defaultMapper.db)
+	c.Assert(Register(`t_users`), check.IsNil)
+	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `1u`, `user@test.com`, 20, false, false, 0, nil, testTime)
+}
+
+// run with -race: tables are registered lazily while queries are running
+func (s *ConcurrentRegisterTS) TestRegisterWhileQuerying(c *check.C) {
+	tables := []string{`t_roles`, `t_user_roles`, `t_audit.t_users`}
+	errs := make(chan error, 10*5+len(tables))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				data, err := Exec(sampleSelect)
+				if err == nil && len(data) != 1 {
+					err = fmt.Errorf(`expected 1 row, got %d`, len(data))
+				}
+				errs <- err
+			}
+		}()
+	}
+	for _, table := range tables {
+		wg.Add(1)
+		go func(table string) {
+			defer wg.Done()
+			errs <- Register(table)
+		}(table)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(len(defaultMapper.registry.load()), check.Equals, 17)
+}
@@ -0,0 +1,347 @@
+package mapper
+
+import (
+	`context`
+	`database/sql`
+	`fmt`
+	`github.com/exklamationmark/glog`
+	`sync/atomic`
+)
+
+var (
+	declareCursorTemplate = `DECLARE %s NO SCROLL CURSOR FOR %s`
+	fetchTemplate         = `FETCH FORWARD %d FROM %s`
+	closeCursorTemplate   = `CLOSE %s`
+	cursorNameTemplate    = `mapper_cursor_%d`
+)
+
+const (
+	streamQueryErr = `only queries giving rows back (selects, or with RETURNING) can be streamed, bulk inserts can't`
+	fetchSizeErr   = `a fetch size can only be given to select queries, and must be > 0, got %d`
+)
+
+// cursorCount numbers the cursors, their names must be unique in a transaction
+var cursorCount uint64
+
+// Rows reads the records of a query one at a time, instead of all of them like Exec. It must be closed:
+//
+//	rows, err := q.Stream()
+//	...
+//	defer rows.Close()
+//	for rows.Next() {
+//		record := rows.Record()
+//	}
+//	err = rows.Err()
+//
+// With a fetch size (Query.FetchSize), rows come from a cursor, FetchSize at a time
+type Rows struct {
+	mapper       *Mapper
+	query        *Query
+	ctx          context.Context
+	rows         *sql.Rows
+	placeholders []interface{}
+	colTypes     []int
+	record       Record
+	err          error
+	closed       bool
+
+	// the running statement: its context (with Configuration.StatementTimeout) and a func to call once its rows are read
+	statement string
+	stmtCtx   context.Context
+	cancel    context.CancelFunc
+	done      func()
+
+	// the cursor and its transaction, given or begun (ownTx) for it
+	tx      *sql.Tx
+	ownTx   bool
+	cursor  string
+	fetched int // rows read from the last FETCH
+}
+
+// FetchSize makes Stream and Iterate read the rows of a select through a cursor, size rows at a time,
+// instead of having postgres send them all at once. The cursor needs a transaction: the Tx it's run in,
+// or one begun for it and ended by Rows.Close. It's not used by Exec, which keeps all the rows anyway
+func (q *Query) FetchSize(size int) *Query {
+	if q.queryType != SelectQuery || size <= 0 {
+		q.setErr(fmt.Errorf(fetchSizeErr, size))
+		return q
+	}
+	q.fetchSize = size
+	return q
+}
+
+// Stream runs a query and gives its records one at a time, see Rows
+func (m *Mapper) Stream(query *Query) (*Rows, error) {
+	return m.StreamContext(context.Background(), query)
+}
+
+// StreamContext is Stream, stopped when ctx is done
+// Configuration.StatementTimeout applies to the query until the Rows are closed, or to each FETCH with a fetch size
+func (m *Mapper) StreamContext(ctx context.Context, query *Query) (*Rows, error) {
+	return m.stream(ctx, m.db, query)
+}
+
+// Stream runs a query on the default mapper and gives its records one at a time
+func Stream(query *Query) (*Rows, error) {
+	return defaultMapper.Stream(query)
+}
+
+// StreamContext runs a query on the default mapper and gives its records one at a time, stopped when ctx is done
+func StreamContext(ctx context.Context, query *Query) (*Rows, error) {
+	return defaultMapper.StreamContext(ctx, query)
+}
+
+// Iterate runs a query and calls fn with each record, until fn returns an error
+// The rows are not all kept in memory, see Stream
+func (m *Mapper) Iterate(query *Query, fn func(Record) error) error {
+	return m.IterateContext(context.Background(), query, fn)
+}
+
+// IterateContext is Iterate, stopped when ctx is done
+func (m *Mapper) IterateContext(ctx context.Context, query *Query, fn func(Record) error) error {
+	rows, err := m.StreamContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	return rows.iterate(fn)
+}
+
+// Iterate runs a query on the default mapper and calls fn with each record
+func Iterate(query *Query, fn func(Record) error) error {
+	return defaultMapper.Iterate(query, fn)
+}
+
+// IterateContext runs a query on the default mapper and calls fn with each record, stopped when ctx is done
+func IterateContext(ctx context.Context, query *Query, fn func(Record) error) error {
+	return defaultMapper.IterateContext(ctx, query, fn)
+}
+
+// Stream runs a query on the mapper that built it and gives its records one at a time
+func (q *Query) Stream() (*Rows, error) {
+	return q.getMapper().Stream(q)
+}
+
+// StreamContext is Stream, stopped when ctx is done
+func (q *Query) StreamContext(ctx context.Context) (*Rows, error) {
+	return q.getMapper().StreamContext(ctx, q)
+}
+
+// Iterate runs a query on the mapper that built it and calls fn with each record
+func (q *Query) Iterate(fn func(Record) error) error {
+	return q.getMapper().Iterate(q, fn)
+}
+
+// IterateContext is Iterate, stopped when ctx is done
+func (q *Query) IterateContext(ctx context.Context, fn func(Record) error) error {
+	return q.getMapper().IterateContext(ctx, q, fn)
+}
+
+// Stream runs a query in the transaction and gives its records one at a time
+// The Rows must be closed before the transaction ends
+func (tx *Tx) Stream(query *Query) (*Rows, error) {
+	return tx.StreamContext(context.Background(), query)
+}
+
+// StreamContext is Stream, stopped when ctx is done
+func (tx *Tx) StreamContext(ctx context.Context, query *Query) (*Rows, error) {
+	if tx.done {
+		return nil, sql.ErrTxDone
+	}
+	return tx.mapper.stream(ctx, tx.tx, query)
+}
+
+// Iterate runs a query in the transaction and calls fn with each record
+func (tx *Tx) Iterate(query *Query, fn func(Record) error) error {
+	return tx.IterateContext(context.Background(), query, fn)
+}
+
+// IterateContext is Iterate, stopped when ctx is done
+func (tx *Tx) IterateContext(ctx context.Context, query *Query, fn func(Record) error) error {
+	rows, err := tx.StreamContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	return rows.iterate(fn)
+}
+
+// stream runs a query with an executor, for its rows to be read one at a time
+func (m *Mapper) stream(ctx context.Context, ex executor, query *Query) (*Rows, error) {
+	if err := m.checkQuery(query); err != nil {
+		return nil, err
+	}
+	if query.queryType == BulkInsertQuery || !query.returnsRows() {
+		return nil, fmt.Errorf(streamQueryErr)
+	}
+	placeholders, colTypes, err := m.createPlaceholders(query)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rows{
+		mapper:       m,
+		query:        query,
+		ctx:          ctx,
+		placeholders: placeholders,
+		colTypes:     colTypes,
+	}
+	if query.fetchSize > 0 {
+		err = r.declare(ex)
+	} else {
+		err = r.open(ex)
+	}
+	if err != nil {
+		r.err = err
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// open runs the query, its rows are the ones to read
+func (r *Rows) open(ex executor) error {
+	r.start(r.query.sql())
+	rows, done, err := r.mapper.queryRows(r.stmtCtx, ex, r.query, r.statement, r.query.args)
+	if err != nil {
+		return err
+	}
+	r.rows, r.done = rows, done
+	return nil
+}
+
+// declare opens a cursor for the query, in the given transaction or in a new one, and fetches the first rows
+// Statements naming the cursor are not prepared, the cache would only fill up with them
+func (r *Rows) declare(ex executor) error {
+	tx, ok := ex.(*sql.Tx)
+	if !ok {
+		var err error
+		if tx, err = r.mapper.db.BeginTx(r.ctx, nil); err != nil {
+			return checkCanceled(r.ctx, beginStatement, fmt.Errorf(cannotBeginErr, err))
+		}
+		r.ownTx = true
+	}
+	r.tx = tx
+
+	cursor := quoteIdentifier(fmt.Sprintf(cursorNameTemplate, atomic.AddUint64(&cursorCount, 1)))
+	r.start(fmt.Sprintf(declareCursorTemplate, cursor, r.query.sql()))
+	if _, err := tx.ExecContext(r.stmtCtx, r.statement, r.query.args...); err != nil {
+		glog.Error(fmt.Sprintf(cannotRunQueryErr, r.statement, err))
+		return checkCanceled(r.stmtCtx, r.statement, err)
+	}
+	r.cursor = cursor
+	return r.fetch()
+}
+
+// fetch reads the next rows of the cursor
+func (r *Rows) fetch() error {
+	r.start(fmt.Sprintf(fetchTemplate, r.query.fetchSize, r.cursor))
+	rows, err := r.tx.QueryContext(r.stmtCtx, r.statement)
+	if err != nil {
+		glog.Error(fmt.Sprintf(cannotRunQueryErr, r.statement, err))
+		return checkCanceled(r.stmtCtx, r.statement, err)
+	}
+	r.rows = rows
+	r.fetched = 0
+	return nil
+}
+
+// start ends the running statement, and gives the next one its context
+func (r *Rows) start(statement string) {
+	r.closeRows()
+	r.statement = statement
+	r.stmtCtx, r.cancel = r.mapper.withTimeout(r.ctx)
+}
+
+// Next reads the next record, it returns false when there's none left or on error (see Err)
+func (r *Rows) Next() bool {
+	if r.closed || r.err != nil {
+		return false
+	}
+
+	for {
+		if r.rows.Next() {
+			r.fetched++
+			r.record, r.err = r.mapper.scanRecord(r.query, r.rows, r.placeholders, r.colTypes)
+			return r.err == nil
+		}
+		if err := r.rows.Err(); err != nil {
+			r.err = checkCanceled(r.stmtCtx, r.statement, err)
+			return false
+		}
+		// a FETCH giving less than asked for is the last one
+		if r.cursor == `` || r.fetched < r.query.fetchSize {
+			return false
+		}
+		if r.err = r.fetch(); r.err != nil {
+			return false
+		}
+	}
+}
+
+// Record gives the record read by the last call to Next
+func (r *Rows) Record() Record {
+	return r.record
+}
+
+// Err gives the error that stopped Next, if any
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close frees the rows, and closes the cursor, or ends the transaction begun for it
+// It can be called more than once, and must be called even when Next returned false
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.closeRows()
+
+	switch {
+	case r.tx == nil:
+		return nil
+	case r.ownTx && r.err != nil:
+		return r.tx.Rollback()
+	case r.ownTx:
+		return r.tx.Commit()
+	case r.cursor != `` && r.err == nil:
+		// the transaction goes on, the cursor would stay open until its end (after an error, it's aborted anyway)
+		_, err := r.tx.ExecContext(r.ctx, fmt.Sprintf(closeCursorTemplate, r.cursor))
+		if err != nil {
+			glog.Error(fmt.Sprintf(cannotRunQueryErr, fmt.Sprintf(closeCursorTemplate, r.cursor), err))
+		}
+		return err
+	}
+	return nil
+}
+
+// closeRows closes the rows of the running statement
+func (r *Rows) closeRows() {
+	if r.rows != nil {
+		r.rows.Close()
+		r.rows = nil
+	}
+	if r.done != nil {
+		r.done()
+		r.done = nil
+	}
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// iterate calls fn with each record, then closes the rows
+func (r *Rows) iterate(fn func(Record) error) (err error) {
+	defer func() {
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for r.Next() {
+		if err := fn(r.Record()); err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
@@ -0,0 +1,123 @@
+package mapper
+
+import (
+	`errors`
+	`fmt`
+	`gopkg.in/check.v1`
+)
+
+type RowsTS struct{}
+
+type RowsExecTS struct{}
+
+func init() {
+	check.Suite(&RowsTS{})
+	check.Suite(&RowsExecTS{})
+}
+
+func (s *RowsTS) TestFetchSize(c *check.C) {
+	q := Select(`t_users.id`).From(`t_users`).FetchSize(100)
+	c.Assert(q.err, check.IsNil)
+	c.Assert(q.fetchSize, check.Equals, 100)
+
+	c.Assert(Select(`t_users.id`).From(`t_users`).FetchSize(0).err, check.ErrorMatches, `a fetch size can only be given to select queries, and must be > 0, got 0`)
+	c.Assert(Update(`t_users`, `age = ?`, 1).Returning(`t_users.id`).FetchSize(10).err, check.ErrorMatches, `a fetch size can only .*`)
+}
+
+func (s *RowsTS) TestStreamErrors(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{`public.t_users.id`: StringType, `public.t_users.age`: Int64Type})
+
+	_, err := m.Stream(m.Update(`t_users`, `age = ?`, 1))
+	c.Assert(err, check.ErrorMatches, `only queries giving rows back .*`)
+	_, err = m.Stream(m.BulkInsert(`t_users`, `id, age`, [][]interface{}{{`1u`, 1}}).Returning(`id`))
+	c.Assert(err, check.ErrorMatches, `only queries giving rows back .*`)
+	_, err = m.Stream(m.Select(`t_users.email`).From(`t_users`))
+	c.Assert(err, check.ErrorMatches, `cannot scan "t_users.email", column is not registered`)
+}
+
+func (s *RowsExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+	for i := 1; i <= 5; i++ {
+		exec(`INSERT INTO t_users (id, email, age, active, created_at) VALUES ($1, $2, $3, $4, $5)`, fmt.Sprintf(`%du`, i), nil, i*10, i%2 == 0, testTime)
+	}
+}
+
+// ages reads the ages of the users, in order
+func ages(c *check.C, rows *Rows) []int64 {
+	var ages []int64
+	for rows.Next() {
+		ages = append(ages, rows.Record()[`t_users.age`].(int64))
+	}
+	c.Assert(rows.Err(), check.IsNil)
+	c.Assert(rows.Close(), check.IsNil)
+	return ages
+}
+
+func (s *RowsExecTS) TestStream(c *check.C) {
+	rows, err := Select(`t_users.age`, `t_users.email`).From(`t_users`).Where(`t_users.age > ?`, 10).Order(`t_users.age`, Asc).Stream()
+	c.Assert(err, check.IsNil)
+	c.Assert(ages(c, rows), check.DeepEquals, []int64{20, 30, 40, 50})
+	c.Assert(rows.Next(), check.Equals, false)
+	c.Assert(rows.Close(), check.IsNil)
+
+	// 5 rows, 2 at a time: the last FETCH gives 1. Then 4, the last FETCH gives none
+	for _, age := range []int{0, 10} {
+		rows, err = Select(`t_users.age`).From(`t_users`).Where(`t_users.age > ?`, age).Order(`t_users.age`, Asc).FetchSize(2).Stream()
+		c.Assert(err, check.IsNil)
+		c.Assert(len(ages(c, rows)), check.Equals, 5-age/10)
+	}
+
+	rows, err = Update(`t_users`, `age = age + 1`).Where(`t_users.active`).Returning(`t_users.age`).Stream()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(ages(c, rows)), check.Equals, 2)
+}
+
+func (s *RowsExecTS) TestIterate(c *check.C) {
+	var total int64
+	err := Select(`t_users.age`).From(`t_users`).FetchSize(2).Iterate(func(record Record) error {
+		total += record[`t_users.age`].(int64)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(total, check.Equals, int64(150))
+
+	stop := errors.New(`stop`)
+	count := 0
+	err = Iterate(Select(`t_users.age`).From(`t_users`).FetchSize(2), func(record Record) error {
+		if count++; count == 3 {
+			return stop
+		}
+		return nil
+	})
+	c.Assert(err, check.Equals, stop)
+	c.Assert(count, check.Equals, 3)
+
+	err = Iterate(Select(`t_users.age`).From(`t_users`).Where(`t_users.age / ? > 0`, 0), func(Record) error { return nil })
+	c.Assert(err, check.ErrorMatches, `.*division by zero.*`)
+}
+
+func (s *RowsExecTS) TestStreamTx(c *check.C) {
+	err := WithTx(func(tx *Tx) error {
+		if _, err := tx.ExecCount(Update(`t_users`, `age = ?`, 1).Where(`t_users.id = ?`, `1u`)); err != nil {
+			return err
+		}
+
+		rows, err := tx.Stream(Select(`t_users.age`).From(`t_users`).Order(`t_users.age`, Asc).FetchSize(3))
+		c.Assert(err, check.IsNil)
+		c.Assert(rows.Next(), check.Equals, true)
+		c.Assert(rows.Record()[`t_users.age`], check.Equals, int64(1))
+		// closing early closes the cursor, the transaction goes on
+		c.Assert(rows.Close(), check.IsNil)
+
+		count := 0
+		err = tx.Iterate(Select(`t_users.age`).From(`t_users`).FetchSize(3), func(Record) error {
+			count++
+			return nil
+		})
+		c.Assert(count, check.Equals, 5)
+		return err
+	})
+	c.Assert(err, check.IsNil)
+}
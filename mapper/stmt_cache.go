@@ -0,0 +1,216 @@
+package mapper
+
+import (
+	`container/list`
+	`context`
+	`database/sql`
+	`sync`
+)
+
+// CacheStats tells how the prepared statement cache is doing, see Configuration.StatementCacheSize
+type CacheStats struct {
+	Hits      uint64 // statements found prepared
+	Misses    uint64 // statements that had to be prepared
+	Skipped   uint64 // statements run without preparing them, as they weren't seen recently
+	Evictions uint64 // statements closed to make room for others
+	Len       int    // statements in the cache
+}
+
+// seenFactor is how many more statements than it caches a stmtCache remembers having seen
+const seenFactor = 4
+
+// stmtCache keeps the most recently used prepared statements, keyed by their sql
+// Statements are prepared on the db, and used in transactions through tx.StmtContext
+// A statement is only prepared the second time it's seen, one-off statements (IN lists of
+// varying length etc) would otherwise evict the ones run over and over
+type stmtCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element // of *cachedStmt
+	lru     *list.List               // most recently used first
+	seen    map[string]*list.Element // of string, statements run once and not prepared
+	seenLRU *list.List               // most recently seen first
+	stats   CacheStats
+}
+
+// cachedStmt is a prepared statement of the cache. An evicted one is closed once nobody is using it
+type cachedStmt struct {
+	statement string
+	stmt      *sql.Stmt
+	users     int
+	evicted   bool
+}
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+		seen:    make(map[string]*list.Element, size*seenFactor),
+		seenLRU: list.New(),
+	}
+}
+
+// get gives the prepared statement for statement, preparing it on db when it's not cached
+// It's nil when the statement wasn't seen recently, release must be called once done with any other
+func (c *stmtCache) get(ctx context.Context, db *sql.DB, statement string) (*cachedStmt, error) {
+	c.mu.Lock()
+	if entry := c.use(statement); entry != nil {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return entry, nil
+	}
+	if !c.seenBefore(statement) {
+		c.stats.Skipped++
+		c.mu.Unlock()
+		return nil, nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	// preparing is a round trip to the db, the cache isn't locked meanwhile
+	stmt, err := db.PrepareContext(ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry := c.use(statement); entry != nil {
+		// prepared by someone else in the meantime
+		stmt.Close()
+		return entry, nil
+	}
+	entry := &cachedStmt{statement: statement, stmt: stmt, users: 1}
+	c.entries[statement] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.evict(c.lru.Back())
+		c.stats.Evictions++
+	}
+	return entry, nil
+}
+
+// cached gives the statement when it's already prepared, nil otherwise. It's never prepared,
+// nor remembered as seen, release must be called once done with it
+func (c *stmtCache) cached(statement string) *cachedStmt {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.use(statement)
+	if entry == nil {
+		c.stats.Skipped++
+		return nil
+	}
+	c.stats.Hits++
+	return entry
+}
+
+// use marks the cached statement as used, or returns nil when it's not cached. c.mu must be held
+func (c *stmtCache) use(statement string) *cachedStmt {
+	el, ok := c.entries[statement]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	entry := el.Value.(*cachedStmt)
+	entry.users++
+	return entry
+}
+
+// seenBefore tells if the statement was seen recently, and if it wasn't, remembers it. c.mu must be held
+func (c *stmtCache) seenBefore(statement string) bool {
+	if el, ok := c.seen[statement]; ok {
+		c.seenLRU.Remove(el)
+		delete(c.seen, statement)
+		return true
+	}
+	c.seen[statement] = c.seenLRU.PushFront(statement)
+	if c.seenLRU.Len() > c.size*seenFactor {
+		delete(c.seen, c.seenLRU.Remove(c.seenLRU.Back()).(string))
+	}
+	return false
+}
+
+// release is called when done with a statement given by get
+func (c *stmtCache) release(entry *cachedStmt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.users--
+	if entry.evicted && entry.users == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// evict removes a statement from the cache, it's closed now or when its last user releases it. c.mu must be held
+func (c *stmtCache) evict(el *list.Element) {
+	entry := c.lru.Remove(el).(*cachedStmt)
+	delete(c.entries, entry.statement)
+	entry.evicted = true
+	if entry.users == 0 {
+		entry.stmt.Close()
+	}
+}
+
+// purge removes all the statements
+func (c *stmtCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+// snapshot gives the counters of the cache
+func (c *stmtCache) snapshot() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Len = c.lru.Len()
+	return stats
+}
+
+// prepared gives the cached prepared statement for statement, ready to run with ex, and a func to call once done with it
+// The statement is nil when the cache is off, or doesn't keep it. The batches of bulk inserts are never cached,
+// each is a one-off statement with a lot of parameters
+// A transaction only uses statements already prepared: preparing one would take another connection of the pool,
+// while the transaction holds its own, and wait for it when the pool is exhausted
+func (m *Mapper) prepared(ctx context.Context, ex executor, query *Query, statement string) (*sql.Stmt, func(), error) {
+	if m.stmts == nil || query.queryType == BulkInsertQuery {
+		return nil, func() {}, nil
+	}
+
+	cache := m.stmts
+	tx, inTx := ex.(*sql.Tx)
+	var entry *cachedStmt
+	if inTx {
+		entry = cache.cached(statement)
+	} else {
+		var err error
+		if entry, err = cache.get(ctx, m.db, statement); err != nil {
+			return nil, nil, err
+		}
+	}
+	if entry == nil {
+		return nil, func() {}, nil
+	}
+	if !inTx {
+		return entry.stmt, func() { cache.release(entry) }, nil
+	}
+	txStmt := tx.StmtContext(ctx, entry.stmt)
+	return txStmt, func() {
+		txStmt.Close()
+		cache.release(entry)
+	}, nil
+}
+
+// StatementCacheStats gives the counters of the prepared statement cache, all 0 when it's off
+func (m *Mapper) StatementCacheStats() CacheStats {
+	if m.stmts == nil {
+		return CacheStats{}
+	}
+	return m.stmts.snapshot()
+}
+
+// StatementCacheStats gives the counters of the prepared statement cache of the default mapper
+func StatementCacheStats() CacheStats {
+	return defaultMapper.StatementCacheStats()
+}
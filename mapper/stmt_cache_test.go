@@ -0,0 +1,181 @@
+package mapper
+
+import (
+	`context`
+	`fmt`
+	`gopkg.in/check.v1`
+	`sync`
+)
+
+type StmtCacheTS struct{}
+
+type StmtCacheExecTS struct{}
+
+func init() {
+	check.Suite(&StmtCacheTS{})
+	check.Suite(&StmtCacheExecTS{})
+}
+
+func (s *StmtCacheTS) TestConfigure(c *check.C) {
+	m := New(nil)
+	c.Assert(m.stmts, check.IsNil)
+	c.Assert(m.StatementCacheStats(), check.Equals, CacheStats{})
+
+	query := &Query{queryType: SelectQuery}
+	stmt, done, err := m.prepared(context.Background(), nil, query, `SELECT 1`)
+	c.Assert(err, check.IsNil)
+	c.Assert(stmt, check.IsNil)
+	done()
+
+	m.Configure(Configuration{StatementCacheSize: 2})
+	c.Assert(m.stmts.size, check.Equals, 2)
+	c.Assert(m.StatementCacheStats(), check.Equals, CacheStats{})
+
+	// seen for the first time, it's not prepared
+	stmt, done, err = m.prepared(context.Background(), nil, query, `SELECT 1`)
+	c.Assert(err, check.IsNil)
+	c.Assert(stmt, check.IsNil)
+	done()
+	c.Assert(m.StatementCacheStats(), check.Equals, CacheStats{Skipped: 1})
+
+	// bulk inserts bypass the cache
+	stmt, done, err = m.prepared(context.Background(), nil, &Query{queryType: BulkInsertQuery}, `INSERT 1`)
+	c.Assert(err, check.IsNil)
+	c.Assert(stmt, check.IsNil)
+	done()
+	c.Assert(m.StatementCacheStats(), check.Equals, CacheStats{Skipped: 1})
+
+	m.Configure(Configuration{})
+	c.Assert(m.stmts, check.IsNil)
+}
+
+func (s *StmtCacheTS) TestSeenBefore(c *check.C) {
+	cache := newStmtCache(1)
+	c.Assert(cache.seenBefore(`SELECT 1`), check.Equals, false)
+	c.Assert(cache.seenBefore(`SELECT 1`), check.Equals, true)
+	// once prepared, it's not remembered as seen anymore
+	c.Assert(cache.seenBefore(`SELECT 1`), check.Equals, false)
+
+	for i := 2; i <= 1+seenFactor; i++ {
+		c.Assert(cache.seenBefore(fmt.Sprintf(`SELECT %d`, i)), check.Equals, false)
+	}
+	c.Assert(cache.seenLRU.Len(), check.Equals, seenFactor)
+	c.Assert(cache.seenBefore(`SELECT 1`), check.Equals, false)
+	c.Assert(cache.seenBefore(fmt.Sprintf(`SELECT %d`, 1+seenFactor)), check.Equals, true)
+}
+
+func (s *StmtCacheTS) TestCached(c *check.C) {
+	cache := newStmtCache(2)
+	c.Assert(cache.cached(`SELECT 1`), check.IsNil)
+	c.Assert(cache.seenLRU.Len(), check.Equals, 0)
+	c.Assert(cache.snapshot(), check.Equals, CacheStats{Skipped: 1})
+
+	cache.entries[`SELECT 1`] = cache.lru.PushFront(&cachedStmt{statement: `SELECT 1`})
+	entry := cache.cached(`SELECT 1`)
+	c.Assert(entry, check.NotNil)
+	c.Assert(entry.users, check.Equals, 1)
+	c.Assert(cache.snapshot(), check.Equals, CacheStats{Hits: 1, Skipped: 1, Len: 1})
+}
+
+func (s *StmtCacheExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	defaultMapper = New(defaultMapper.db)
+	Configure(Configuration{StatementCacheSize: 2})
+	c.Assert(Register(`t_users`), check.IsNil)
+	_, err := Exec(sampleInsert)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *StmtCacheExecTS) TearDownTest(c *check.C) {
+	// the tables are dropped by the next test, its statements must not outlive them
+	Configure(Configuration{})
+	defaultMapper = New(defaultMapper.db)
+}
+
+func (s *StmtCacheExecTS) TestHitsAndMisses(c *check.C) {
+	for _, age := range []int{10, 20, 30} {
+		data, err := Select(`t_users.id`).From(`t_users`).Where(`t_users.age > ?`, age).Run()
+		c.Assert(err, check.IsNil)
+		c.Assert(len(data), check.Equals, 1)
+	}
+	// the insert of SetUpTest and the first select were seen for the first time
+	c.Assert(StatementCacheStats(), check.Equals, CacheStats{Hits: 1, Misses: 1, Skipped: 2, Len: 1})
+
+	for _, age := range []int{41, 42} {
+		count, err := Update(`t_users`, `age = ?`, age).RunCount()
+		c.Assert(err, check.IsNil)
+		c.Assert(count, check.Equals, int64(1))
+	}
+	c.Assert(StatementCacheStats(), check.Equals, CacheStats{Hits: 1, Misses: 2, Skipped: 3, Len: 2})
+
+	// the insert is seen again, the select makes room for it
+	_, err := Exec(sampleInsert)
+	c.Assert(err, check.ErrorMatches, `.*duplicate key.*`)
+	c.Assert(StatementCacheStats(), check.Equals, CacheStats{Hits: 1, Misses: 3, Skipped: 3, Evictions: 1, Len: 2})
+
+	// registering a table again empties the cache
+	c.Assert(Register(`t_users`), check.IsNil)
+	c.Assert(StatementCacheStats().Len, check.Equals, 0)
+}
+
+func (s *StmtCacheExecTS) TestBulkInsert(c *check.C) {
+	for i := 0; i < 2; i++ {
+		_, err := BulkInsert(`t_users`, `id, email, age, active, created_at`,
+			[][]interface{}{{fmt.Sprintf(`b%du`, i), fmt.Sprintf(`b%d@viki.com`, i), 20, true, testTime}}).RunCount()
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(StatementCacheStats(), check.Equals, CacheStats{Skipped: 1})
+}
+
+func (s *StmtCacheExecTS) TestTx(c *check.C) {
+	// run twice, the query is prepared
+	query := Select(`t_users.age`).From(`t_users`).Where(`t_users.id = ?`, `2u`)
+	for i := 0; i < 2; i++ {
+		_, err := query.Run()
+		c.Assert(err, check.IsNil)
+	}
+
+	err := WithTx(func(tx *Tx) error {
+		if _, err := tx.ExecCount(Update(`t_users`, `age = ?`, 50)); err != nil {
+			return err
+		}
+		data, err := tx.Exec(query)
+		c.Assert(err, check.IsNil)
+		c.Assert(data[0][`t_users.age`], check.Equals, int64(50))
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(StatementCacheStats().Hits, check.Equals, uint64(1))
+
+	data, err := query.Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(data[0][`t_users.age`], check.Equals, int64(50))
+}
+
+func (s *StmtCacheExecTS) TestConcurrent(c *check.C) {
+	queries := []*Query{
+		Select(`t_users.id`).From(`t_users`).Where(`t_users.age > ?`, 10),
+		Select(`t_users.email`).From(`t_users`).Where(`t_users.age > ?`, 10),
+		Select(`t_users.age`).From(`t_users`).Where(`t_users.age > ?`, 10),
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(q *Query) {
+			defer wg.Done()
+			_, err := q.Run()
+			errs <- err
+		}(queries[i%len(queries)])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, check.IsNil)
+	}
+
+	stats := StatementCacheStats()
+	c.Assert(stats.Hits+stats.Misses+stats.Skipped, check.Equals, uint64(31))
+	c.Assert(stats.Len, check.Equals, 2)
+}
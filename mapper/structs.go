@@ -0,0 +1,405 @@
+package mapper
+
+import (
+	`database/sql`
+	`database/sql/driver`
+	`encoding/json`
+	`errors`
+	`fmt`
+	`math`
+	`reflect`
+	`sort`
+	`strings`
+)
+
+const (
+	tagName = `db`
+
+	invalidDestErr       = `destination must be a pointer to a struct or to a slice of structs, got %v`
+	missingFieldErr      = `no field of %v is tagged for column "%s"`
+	incompatibleFieldErr = `cannot put column "%s" (%T) into field %v.%s (%v)`
+	overflowFieldErr     = `cannot put column "%s" (%v) into field %v.%s (%v), the value doesn't fit`
+	ambiguousFieldErr    = `columns "%s" and "%s" both go into field %v.%s, tag it with the full name of one of them`
+	invalidSourceErr     = `value must be a struct or a pointer to a struct, got %v`
+	noColumnsErr         = `no column to write from %v`
+	unregisteredFieldErr = `field %v.%s is tagged for column "%s", which is not registered for table "%s"`
+	noKeyColumnsErr      = `at least 1 key column is needed to update table "%s"`
+	missingKeyErr        = `key column "%s" is not a field of %v`
+
+	// tag option to skip a field with a zero value in InsertStruct and UpdateStruct
+	omitEmptyOption = `omitempty`
+)
+
+var (
+	valuerReflectType  = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	rawJSONReflectType = reflect.TypeOf(json.RawMessage{})
+
+	// why assignField couldn't put a value into a field, scanStruct tells which column and field
+	errIncompatible = errors.New(`incompatible types`)
+	errOverflow     = errors.New(`value out of range`)
+)
+
+// Into runs a query and puts the results into dest, which is either
+//   - a pointer to a slice of structs (or of pointers to structs), filled with all the rows
+//   - a pointer to a struct, filled with the first row. sql.ErrNoRows is returned when there's none
+//
+// Columns are matched to struct fields via `db` tags, see ScanStructs
+func (q *Query) Into(dest interface{}) error {
+	records, err := q.Run()
+	if err != nil {
+		return err
+	}
+	return ScanStructs(records, dest)
+}
+
+// ScanStructs copies records (from Exec) into dest, see Query.Into for what dest can be
+// A column goes to the field whose `db` tag is either the full select field ("t_users.id") or only the column name ("id")
+// Every column must have a field, and only one: tag fields with the full name when joined tables have the same column.
+// Fields without a column are left alone. Numbers must fit the field (no negative value into an unsigned field)
+// Nullable values (sql.NullString, etc) can go into fields of the nullable type, of the base type
+// (zero value for NULL) or of a pointer to the base type (nil for NULL). json columns can go into any field json can decode into
+func ScanStructs(records []Record, dest interface{}) error {
+	destValue := reflect.ValueOf(dest)
+	if destValue.Kind() != reflect.Ptr || destValue.IsNil() {
+		return fmt.Errorf(invalidDestErr, reflect.TypeOf(dest))
+	}
+	destValue = destValue.Elem()
+
+	switch destValue.Kind() {
+	case reflect.Struct:
+		if len(records) == 0 {
+			return sql.ErrNoRows
+		}
+		fields, err := structFields(destValue.Type(), records[0])
+		if err != nil {
+			return err
+		}
+		return scanStruct(records[0], fields, destValue)
+	case reflect.Slice:
+		elemType := destValue.Type().Elem()
+		structType := elemType
+		if structType.Kind() == reflect.Ptr {
+			structType = structType.Elem()
+		}
+		if structType.Kind() != reflect.Struct {
+			return fmt.Errorf(invalidDestErr, reflect.TypeOf(dest))
+		}
+
+		results := reflect.MakeSlice(destValue.Type(), 0, len(records))
+		if len(records) == 0 {
+			destValue.Set(results)
+			return nil
+		}
+		fields, err := structFields(structType, records[0])
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			item := reflect.New(structType)
+			if err := scanStruct(record, fields, item.Elem()); err != nil {
+				return err
+			}
+			if elemType.Kind() != reflect.Ptr {
+				item = item.Elem()
+			}
+			results = reflect.Append(results, item)
+		}
+		destValue.Set(results)
+		return nil
+	}
+
+	return fmt.Errorf(invalidDestErr, reflect.TypeOf(dest))
+}
+
+// tagOptions is the name and options of a `db` tag, e.g. `db:"email,omitempty"`
+type tagOptions struct {
+	name    string
+	options []string
+}
+
+func parseTag(tag string) tagOptions {
+	parts := strings.Split(tag, `,`)
+	return tagOptions{name: parts[0], options: parts[1:]}
+}
+
+func (t tagOptions) has(option string) bool {
+	for _, o := range t.options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// structFields finds the index of the field for every column in a record
+func structFields(structType reflect.Type, record Record) (map[string]int, error) {
+	tagged := make(map[string]int, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		tag := parseTag(structType.Field(i).Tag.Get(tagName))
+		if tag.name != `` && tag.name != `-` {
+			tagged[tag.name] = i
+		}
+	}
+
+	// a field tagged with a column name alone can match the column of 2 tables ("t_users.id" and "t_roles.id")
+	columns := make([]string, 0, len(record))
+	for column := range record {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	fields := make(map[string]int, len(record))
+	columnOf := make(map[int]string, len(record))
+	for _, column := range columns {
+		index, ok := tagged[column]
+		if !ok {
+			index, ok = tagged[column[strings.LastIndex(column, `.`)+1:]]
+		}
+		if !ok {
+			return nil, fmt.Errorf(missingFieldErr, structType, column)
+		}
+		if other, taken := columnOf[index]; taken {
+			return nil, fmt.Errorf(ambiguousFieldErr, other, column, structType, structType.Field(index).Name)
+		}
+		fields[column] = index
+		columnOf[index] = column
+	}
+	return fields, nil
+}
+
+func scanStruct(record Record, fields map[string]int, structValue reflect.Value) error {
+	for column, value := range record {
+		index := fields[column]
+		if err := assignField(structValue.Field(index), value); err != nil {
+			structField := structValue.Type().Field(index)
+			if err == errOverflow {
+				return fmt.Errorf(overflowFieldErr, column, value, structValue.Type(), structField.Name, structField.Type)
+			}
+			return fmt.Errorf(incompatibleFieldErr, column, value, structValue.Type(), structField.Name, structField.Type)
+		}
+	}
+	return nil
+}
+
+// assignField puts a value from a Record into a struct field, converting it when it makes sense
+// returns errIncompatible when the value doesn't fit the type, errOverflow when it doesn't fit its range
+func assignField(field reflect.Value, value interface{}) error {
+	if !field.CanSet() {
+		return errIncompatible
+	}
+
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	valueType := reflect.TypeOf(value)
+	if valueType.AssignableTo(field.Type()) {
+		field.Set(reflect.ValueOf(value))
+		return nil
+	}
+
+	// nullable types: take the value out, nil for NULL
+	if valueType.Implements(valuerReflectType) {
+		inner, err := value.(driver.Valuer).Value()
+		if err != nil {
+			return errIncompatible
+		}
+		if inner == nil {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		return assignField(field, inner)
+	}
+
+	// NULL json/bytea/array columns come as nil slices
+	if reflect.ValueOf(value).Kind() == reflect.Slice && reflect.ValueOf(value).IsNil() {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	if field.Kind() == reflect.Ptr {
+		elem := reflect.New(field.Type().Elem())
+		if err := assignField(elem.Elem(), value); err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+
+	if valueType == rawJSONReflectType {
+		if json.Unmarshal(value.(json.RawMessage), field.Addr().Interface()) != nil {
+			return errIncompatible
+		}
+		return nil
+	}
+
+	// int64 into int, float64 into float32, string into a named string type, etc
+	if !sameKindFamily(valueType.Kind(), field.Kind()) || !valueType.ConvertibleTo(field.Type()) {
+		return errIncompatible
+	}
+	if overflows(reflect.ValueOf(value), field) {
+		return errOverflow
+	}
+	field.Set(reflect.ValueOf(value).Convert(field.Type()))
+	return nil
+}
+
+// overflows tells if a number can't be converted to the type of field without changing:
+// it's out of the range of the type, or negative for an unsigned type
+func overflows(value, field reflect.Value) bool {
+	switch kindFamily(value.Kind()) {
+	case reflect.Int:
+		if isUnsigned(value.Kind()) {
+			n := value.Uint()
+			if isUnsigned(field.Kind()) {
+				return field.OverflowUint(n)
+			}
+			return n > math.MaxInt64 || field.OverflowInt(int64(n))
+		}
+		n := value.Int()
+		if isUnsigned(field.Kind()) {
+			return n < 0 || field.OverflowUint(uint64(n))
+		}
+		return field.OverflowInt(n)
+	case reflect.Float64:
+		return field.OverflowFloat(value.Float())
+	}
+	return false
+}
+
+func isUnsigned(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+// sameKindFamily tells if converting between 2 kinds keeps the meaning (no int into string)
+func sameKindFamily(a, b reflect.Kind) bool {
+	return kindFamily(a) != reflect.Invalid && kindFamily(a) == kindFamily(b)
+}
+
+func kindFamily(kind reflect.Kind) reflect.Kind {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.Int
+	case reflect.Float32, reflect.Float64:
+		return reflect.Float64
+	case reflect.String, reflect.Bool, reflect.Slice:
+		return kind
+	}
+	return reflect.Invalid
+}
+
+// InsertStruct starts an insert query of a struct into a table. The columns and args come from the `db` tags
+// Fields tagged `db:"-"` or not tagged are left out, fields tagged with omitempty (`db:"email,omitempty"`) are left out
+// when they have a zero value, so that the column gets its default. Every column must be registered for the table
+func (m *Mapper) InsertStruct(table string, v interface{}) *Query {
+	columns, args, err := m.structColumns(parseTable(table), v)
+	if err != nil {
+		return &Query{mapper: m, queryType: InsertQuery, err: err}
+	}
+	return m.Insert(table, strings.Join(columns, `, `), args...)
+}
+
+// InsertStruct starts an insert query of a struct on the default mapper
+func InsertStruct(table string, v interface{}) *Query {
+	return defaultMapper.InsertStruct(table, v)
+}
+
+// UpdateStruct starts an update query of the row with the same key columns as the struct
+// Every other column of the struct is set, following the same rules as InsertStruct
+// Key columns are always used, even with omitempty
+func (m *Mapper) UpdateStruct(table string, v interface{}, keyColumns ...string) *Query {
+	if len(keyColumns) == 0 {
+		return &Query{mapper: m, queryType: UpdateQuery, err: fmt.Errorf(noKeyColumnsErr, table)}
+	}
+
+	isKey := make(map[string]bool, len(keyColumns))
+	for _, column := range keyColumns {
+		isKey[column] = true
+	}
+	columns, args, err := m.structColumns(parseTable(table), v, keyColumns...)
+	if err != nil {
+		return &Query{mapper: m, queryType: UpdateQuery, err: err}
+	}
+
+	var sets []string
+	var conditions []Predicate
+	var setArgs []interface{}
+	for i, column := range columns {
+		if isKey[column] {
+			conditions = append(conditions, Eq(column, args[i]))
+			continue
+		}
+		sets = append(sets, quoteIdentifier(column)+` = `+placeHolder)
+		setArgs = append(setArgs, args[i])
+	}
+	if len(sets) == 0 {
+		return &Query{mapper: m, queryType: UpdateQuery, err: fmt.Errorf(noColumnsErr, reflect.TypeOf(v))}
+	}
+	for _, column := range keyColumns {
+		if !containsString(columns, column) {
+			return &Query{mapper: m, queryType: UpdateQuery, err: fmt.Errorf(missingKeyErr, column, reflect.TypeOf(v))}
+		}
+	}
+
+	return m.Update(table, strings.Join(sets, `, `), setArgs...).Where(And(conditions...))
+}
+
+// UpdateStruct starts an update query of a struct on the default mapper
+func UpdateStruct(table string, v interface{}, keyColumns ...string) *Query {
+	return defaultMapper.UpdateStruct(table, v, keyColumns...)
+}
+
+// structColumns returns the columns of a struct to write, with their values, following the `db` tags
+// keepColumns are never left out for omitempty
+func (m *Mapper) structColumns(tb tableName, v interface{}, keepColumns ...string) ([]string, []interface{}, error) {
+	structValue := reflect.ValueOf(v)
+	if structValue.Kind() == reflect.Ptr && !structValue.IsNil() {
+		structValue = structValue.Elem()
+	}
+	if structValue.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf(invalidSourceErr, reflect.TypeOf(v))
+	}
+
+	structType := structValue.Type()
+	columns := make([]string, 0, structType.NumField())
+	args := make([]interface{}, 0, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		tag := parseTag(structType.Field(i).Tag.Get(tagName))
+		if tag.name == `` || tag.name == `-` || structType.Field(i).PkgPath != `` {
+			continue
+		}
+
+		// tags can be qualified ("t_users.email"), but only the column name is written
+		column := tag.name[strings.LastIndex(tag.name, `.`)+1:]
+		field := structValue.Field(i)
+		if tag.has(omitEmptyOption) && field.IsZero() && !containsString(keepColumns, column) {
+			continue
+		}
+		if _, ok := m.columnType([]tableName{tb}, column); !ok {
+			return nil, nil, fmt.Errorf(unregisteredFieldErr, structType, structType.Field(i).Name, column, tb)
+		}
+
+		columns = append(columns, column)
+		args = append(args, field.Interface())
+	}
+
+	if len(columns) == 0 {
+		return nil, nil, fmt.Errorf(noColumnsErr, structType)
+	}
+	return columns, args, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
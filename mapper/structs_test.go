@@ -0,0 +1,232 @@
+package mapper
+
+import (
+	`database/sql`
+	`encoding/json`
+	`github.com/lib/pq`
+	`gopkg.in/check.v1`
+	`time`
+)
+
+type StructsTS struct{}
+
+type IntoExecTS struct{}
+
+func init() {
+	check.Suite(&StructsTS{})
+	check.Suite(&IntoExecTS{})
+}
+
+type testUser struct {
+	ID            string       `db:"id"`
+	Email         *string      `db:"t_users.email"`
+	Age           int          `db:"age"`
+	Active        bool         `db:"active"`
+	EmailVerified sql.NullBool `db:"email_verified"`
+	Licenses      int32        `db:"no_of_licenses"`
+	LastPaymentAt *time.Time   `db:"last_payment_at"`
+	CreatedAt     time.Time    `db:"created_at"`
+	Meta          *testMeta    `db:"meta"`
+	Ignored       string       `db:"-"`
+	Untagged      string
+}
+
+var testRecords = []Record{
+	{
+		`t_users.id`:              `1u`,
+		`t_users.email`:           sql.NullString{Valid: true, String: `user@test.com`},
+		`t_users.age`:             int64(20),
+		`t_users.active`:          true,
+		`t_users.email_verified`:  sql.NullBool{Valid: true, Bool: true},
+		`t_users.no_of_licenses`:  sql.NullInt64{Valid: true, Int64: 3},
+		`t_users.last_payment_at`: pq.NullTime{Valid: true, Time: testTime},
+		`t_users.created_at`:      testTime,
+		`t_users.meta`:            json.RawMessage(`{"source":"api"}`),
+	},
+	{
+		`t_users.id`:              `2u`,
+		`t_users.email`:           sql.NullString{},
+		`t_users.age`:             int64(40),
+		`t_users.active`:          false,
+		`t_users.email_verified`:  sql.NullBool{},
+		`t_users.no_of_licenses`:  sql.NullInt64{},
+		`t_users.last_payment_at`: pq.NullTime{},
+		`t_users.created_at`:      testTime,
+		`t_users.meta`:            json.RawMessage(nil),
+	},
+}
+
+func (s *StructsTS) TestScanSlice(c *check.C) {
+	var users []testUser
+	c.Assert(ScanStructs(testRecords, &users), check.IsNil)
+	c.Assert(len(users), check.Equals, 2)
+
+	email := `user@test.com`
+	c.Assert(users[0], check.DeepEquals, testUser{
+		ID:            `1u`,
+		Email:         &email,
+		Age:           20,
+		Active:        true,
+		EmailVerified: sql.NullBool{Valid: true, Bool: true},
+		Licenses:      3,
+		LastPaymentAt: &testTime,
+		CreatedAt:     testTime,
+		Meta:          &testMeta{`api`},
+	})
+	c.Assert(users[1], check.DeepEquals, testUser{
+		ID:        `2u`,
+		Age:       40,
+		CreatedAt: testTime,
+	})
+}
+
+func (s *StructsTS) TestScanPointers(c *check.C) {
+	var users []*testUser
+	c.Assert(ScanStructs(testRecords, &users), check.IsNil)
+	c.Assert(len(users), check.Equals, 2)
+	c.Assert(users[1].ID, check.Equals, `2u`)
+
+	var user testUser
+	c.Assert(ScanStructs(testRecords, &user), check.IsNil)
+	c.Assert(user.ID, check.Equals, `1u`)
+	c.Assert(ScanStructs(nil, &user), check.Equals, sql.ErrNoRows)
+}
+
+func (s *StructsTS) TestScanErrors(c *check.C) {
+	var users []testUser
+	c.Assert(ScanStructs(testRecords, users), check.ErrorMatches, `destination must be a pointer to a struct or to a slice of structs, got \[\]mapper.testUser`)
+
+	var ids []string
+	c.Assert(ScanStructs(testRecords, &ids), check.ErrorMatches, `destination must be a pointer to a struct or to a slice of structs, got \*\[\]string`)
+
+	var partial []struct {
+		ID string `db:"id"`
+	}
+	c.Assert(ScanStructs(testRecords, &partial), check.ErrorMatches, `no field of struct .* is tagged for column "t_users\..*"`)
+
+	var wrong []struct {
+		ID int64 `db:"id"`
+	}
+	c.Assert(ScanStructs([]Record{{`t_users.id`: `1u`}}, &wrong), check.ErrorMatches, `cannot put column "t_users.id" \(string\) into field struct .*\.ID \(int64\)`)
+
+	var small []struct {
+		Age int8 `db:"age"`
+	}
+	c.Assert(ScanStructs([]Record{{`t_users.age`: int64(127)}}, &small), check.IsNil)
+	c.Assert(small[0].Age, check.Equals, int8(127))
+	c.Assert(ScanStructs([]Record{{`t_users.age`: int64(300)}}, &small), check.ErrorMatches, `cannot put column "t_users.age" \(300\) into field struct .*\.Age \(int8\), the value doesn't fit`)
+
+	var unsigned []struct {
+		Age *uint32 `db:"age"`
+	}
+	c.Assert(ScanStructs([]Record{{`t_users.age`: sql.NullInt64{Valid: true, Int64: 20}}}, &unsigned), check.IsNil)
+	c.Assert(*unsigned[0].Age, check.Equals, uint32(20))
+	c.Assert(ScanStructs([]Record{{`t_users.age`: int64(-1)}}, &unsigned), check.ErrorMatches, `.*\.Age \(\*uint32\), the value doesn't fit`)
+	c.Assert(ScanStructs([]Record{{`t_users.age`: int64(1 << 40)}}, &unsigned), check.ErrorMatches, `.*the value doesn't fit`)
+
+	var ratio []struct {
+		Ratio float32 `db:"ratio"`
+	}
+	c.Assert(ScanStructs([]Record{{`ratio`: 1e300}}, &ratio), check.ErrorMatches, `.*the value doesn't fit`)
+
+	var joined []struct {
+		ID string `db:"id"`
+	}
+	joinRecords := []Record{{`t_users.id`: `1u`, `t_roles.id`: `1r`}}
+	c.Assert(ScanStructs(joinRecords, &joined), check.ErrorMatches, `columns "t_roles.id" and "t_users.id" both go into field struct .*\.ID, tag it with the full name of one of them`)
+
+	var tagged []struct {
+		UserID string `db:"t_users.id"`
+		RoleID string `db:"t_roles.id"`
+	}
+	c.Assert(ScanStructs(joinRecords, &tagged), check.IsNil)
+	c.Assert(tagged[0].RoleID, check.Equals, `1r`)
+}
+
+type testRole struct {
+	ID            string `db:"id"`
+	Name          string `db:"t_roles.name,omitempty"`
+	RequiredKarma *int   `db:"required_karma"`
+	Note          string `db:"-"`
+	internal      string `db:"internal"`
+}
+
+func newTestRoleMapper() *Mapper {
+	m := New(nil)
+	m.registry.add(map[string]int{
+		`public.t_roles.id`:             StringType,
+		`public.t_roles.name`:           StringType,
+		`public.t_roles.required_karma`: Int64Type,
+	})
+	return m
+}
+
+func (s *StructsTS) TestInsertStruct(c *check.C) {
+	m := newTestRoleMapper()
+	karma := 100
+
+	q := m.InsertStruct(`t_roles`, testRole{ID: `1r`, Name: `Code monkey`, RequiredKarma: &karma, Note: `x`})
+	testQuery(c, q, InsertQuery, `INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3)`, nil, []interface{}{`1r`, `Code monkey`, &karma})
+
+	q = m.InsertStruct(`t_roles`, &testRole{ID: `1r`})
+	testQuery(c, q, InsertQuery, `INSERT INTO "t_roles" ("id", "required_karma") VALUES ($1, $2)`, nil, []interface{}{`1r`, nil})
+}
+
+func (s *StructsTS) TestUpdateStruct(c *check.C) {
+	m := newTestRoleMapper()
+
+	q := m.UpdateStruct(`t_roles`, testRole{ID: `1r`, Name: `Bug eagle`}, `id`)
+	testQuery(c, q, UpdateQuery, `UPDATE "t_roles" SET "name" = $1, "required_karma" = $2 WHERE "id" = $3`, nil, []interface{}{`Bug eagle`, nil, `1r`})
+
+	q = m.UpdateStruct(`t_roles`, testRole{ID: `1r`}, `id`, `name`)
+	testQuery(c, q, UpdateQuery, `UPDATE "t_roles" SET "required_karma" = $1 WHERE "id" = $2 AND "name" = $3`, nil, []interface{}{nil, `1r`, ``})
+}
+
+func (s *StructsTS) TestStructQueryErrors(c *check.C) {
+	m := newTestRoleMapper()
+
+	var tests = []testEntry{
+		{m.InsertStruct(`t_roles`, `1r`).err, check.ErrorMatches, `value must be a struct or a pointer to a struct, got string`},
+		{m.InsertStruct(`t_users`, testRole{ID: `1r`}).err, check.ErrorMatches, `field mapper.testRole.ID is tagged for column "id", which is not registered for table "t_users"`},
+		{m.InsertStruct(`t_roles`, struct{ ID string }{}).err, check.ErrorMatches, `no column to write from struct { ID string }`},
+		{m.UpdateStruct(`t_roles`, testRole{ID: `1r`}).err, check.ErrorMatches, `at least 1 key column is needed to update table "t_roles"`},
+		{m.UpdateStruct(`t_roles`, testRole{ID: `1r`}, `code`).err, check.ErrorMatches, `key column "code" is not a field of mapper.testRole`},
+	}
+	tableCheck(c, tests)
+}
+
+func (s *IntoExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+	exec(`INSERT INTO t_users (id, email, age, active, email_verified, no_of_licenses, last_payment_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, `1u`, nil, 20, false, false, 0, nil, testTime)
+}
+
+func (s *IntoExecTS) TestInsertUpdateStruct(c *check.C) {
+	c.Assert(Register(`t_roles`), check.IsNil)
+	karma := 100
+
+	_, err := InsertStruct(`t_roles`, testRole{ID: `1r`, Name: `Code monkey`, RequiredKarma: &karma}).Run()
+	c.Assert(err, check.IsNil)
+	karma = 500
+	_, err = UpdateStruct(`t_roles`, testRole{ID: `1r`, RequiredKarma: &karma}, `id`).Run()
+	c.Assert(err, check.IsNil)
+
+	var role testRole
+	c.Assert(Select(`t_roles.id`, `t_roles.name`, `t_roles.required_karma`).From(`t_roles`).Into(&role), check.IsNil)
+	c.Assert(role.Name, check.Equals, `Code monkey`)
+	c.Assert(*role.RequiredKarma, check.Equals, 500)
+}
+
+func (s *IntoExecTS) TestInto(c *check.C) {
+	var users []struct {
+		ID    string  `db:"id"`
+		Email *string `db:"email"`
+		Age   int     `db:"age"`
+	}
+	err := Select(`t_users.id`, `t_users.email`, `t_users.age`).From(`t_users`).Into(&users)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(users), check.Equals, 1)
+	c.Assert(users[0].ID, check.Equals, `1u`)
+	c.Assert(users[0].Email, check.IsNil)
+	c.Assert(users[0].Age, check.Equals, 20)
+}
@@ -0,0 +1,227 @@
+package mapper
+
+import (
+	`context`
+	`database/sql`
+	`errors`
+	`fmt`
+	`github.com/exklamationmark/glog`
+	`github.com/lib/pq`
+)
+
+const (
+	defaultTxRetries = 3
+
+	savepointTemplate         = `SAVEPOINT %s`
+	releaseSavepointTemplate  = `RELEASE SAVEPOINT %s`
+	rollbackSavepointTemplate = `ROLLBACK TO SAVEPOINT %s`
+	savepointNameTemplate     = `mapper_sp_%d`
+	beginStatement            = `BEGIN`
+
+	cannotBeginErr = `cannot begin transaction, err=%v`
+	txRetryMsg     = `retrying transaction (attempt %d) after err=%v`
+)
+
+// sqlstates of errors after which a transaction can be run again
+var retryableCodes = map[pq.ErrorCode]bool{
+	`40001`: true, // serialization_failure
+	`40P01`: true, // deadlock_detected
+}
+
+// Tx is a transaction, any Query can be run in it with Exec or ExecCount
+// Calling Begin on a Tx starts a nested transaction, backed by a savepoint
+type Tx struct {
+	mapper    *Mapper
+	tx        *sql.Tx
+	savepoint string // empty for the outermost transaction
+	depth     int
+	done      bool
+}
+
+// Begin starts a transaction with the default isolation level
+func (m *Mapper) Begin() (*Tx, error) {
+	return m.BeginLevel(sql.LevelDefault)
+}
+
+// Begin starts a transaction on the default mapper
+func Begin() (*Tx, error) {
+	return defaultMapper.Begin()
+}
+
+// BeginLevel starts a transaction with an isolation level (sql.LevelSerializable, etc)
+func (m *Mapper) BeginLevel(level sql.IsolationLevel) (*Tx, error) {
+	return m.BeginContext(context.Background(), level)
+}
+
+// BeginContext starts a transaction with an isolation level, rolled back if ctx is done before it's committed
+func (m *Mapper) BeginContext(ctx context.Context, level sql.IsolationLevel) (*Tx, error) {
+	tx, err := m.db.BeginTx(ctx, &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return nil, checkCanceled(ctx, beginStatement, fmt.Errorf(cannotBeginErr, err))
+	}
+	return &Tx{mapper: m, tx: tx}, nil
+}
+
+// BeginLevel starts a transaction with an isolation level on the default mapper
+func BeginLevel(level sql.IsolationLevel) (*Tx, error) {
+	return defaultMapper.BeginLevel(level)
+}
+
+// BeginContext starts a transaction with an isolation level on the default mapper
+func BeginContext(ctx context.Context, level sql.IsolationLevel) (*Tx, error) {
+	return defaultMapper.BeginContext(ctx, level)
+}
+
+// Begin starts a nested transaction, with a savepoint. Commit releases the savepoint,
+// Rollback only undoes what was done since the savepoint
+func (tx *Tx) Begin() (*Tx, error) {
+	if tx.done {
+		return nil, sql.ErrTxDone
+	}
+
+	nested := &Tx{
+		mapper:    tx.mapper,
+		tx:        tx.tx,
+		depth:     tx.depth + 1,
+		savepoint: fmt.Sprintf(savepointNameTemplate, tx.depth+1),
+	}
+	if _, err := tx.tx.Exec(fmt.Sprintf(savepointTemplate, nested.savepoint)); err != nil {
+		return nil, fmt.Errorf(cannotBeginErr, err)
+	}
+	return nested, nil
+}
+
+// Exec runs a query in the transaction and extract results as a map
+func (tx *Tx) Exec(query *Query) ([]Record, error) {
+	return tx.ExecContext(context.Background(), query)
+}
+
+// ExecContext runs a query in the transaction, stopped when ctx is done
+func (tx *Tx) ExecContext(ctx context.Context, query *Query) ([]Record, error) {
+	if tx.done {
+		return nil, sql.ErrTxDone
+	}
+	return tx.mapper.exec(ctx, tx.tx, query)
+}
+
+// ExecCount runs a query in the transaction and returns the no of rows it wrote
+func (tx *Tx) ExecCount(query *Query) (int64, error) {
+	return tx.ExecCountContext(context.Background(), query)
+}
+
+// ExecCountContext runs a query in the transaction and returns the no of rows it wrote, stopped when ctx is done
+func (tx *Tx) ExecCountContext(ctx context.Context, query *Query) (int64, error) {
+	if tx.done {
+		return 0, sql.ErrTxDone
+	}
+	return tx.mapper.execCount(ctx, tx.tx, query)
+}
+
+// Commit commits the transaction, or releases the savepoint of a nested one
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+
+	if tx.savepoint == `` {
+		return tx.tx.Commit()
+	}
+	_, err := tx.tx.Exec(fmt.Sprintf(releaseSavepointTemplate, tx.savepoint))
+	return err
+}
+
+// Rollback aborts the transaction, or goes back to the savepoint of a nested one
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+
+	if tx.savepoint == `` {
+		return tx.tx.Rollback()
+	}
+	_, err := tx.tx.Exec(fmt.Sprintf(rollbackSavepointTemplate, tx.savepoint))
+	return err
+}
+
+// WithTx runs fn in a transaction, committed when fn returns nil and rolled back otherwise (or when fn panics)
+// When the transaction fails on a serialization failure or a deadlock, it's run again from the start,
+// up to Configuration.MaxTxRetries times. fn must then be safe to run more than once
+func (m *Mapper) WithTx(fn func(tx *Tx) error) error {
+	return m.WithTxLevel(sql.LevelDefault, fn)
+}
+
+// WithTx runs fn in a transaction on the default mapper
+func WithTx(fn func(tx *Tx) error) error {
+	return defaultMapper.WithTx(fn)
+}
+
+// WithTxLevel is WithTx with an isolation level. Retries matter most with sql.LevelSerializable
+func (m *Mapper) WithTxLevel(level sql.IsolationLevel, fn func(tx *Tx) error) error {
+	return m.WithTxContext(context.Background(), level, fn)
+}
+
+// WithTxLevel runs fn in a transaction with an isolation level on the default mapper
+func WithTxLevel(level sql.IsolationLevel, fn func(tx *Tx) error) error {
+	return defaultMapper.WithTxLevel(level, fn)
+}
+
+// WithTxContext is WithTxLevel, with the transaction rolled back if ctx is done before it's committed
+// fn should pass ctx on to the queries it runs (Tx.ExecContext). No retry is made once ctx is done
+func (m *Mapper) WithTxContext(ctx context.Context, level sql.IsolationLevel, fn func(tx *Tx) error) error {
+	retries := m.config.MaxTxRetries
+	if retries == 0 {
+		retries = defaultTxRetries
+	}
+
+	for attempt := 0; ; attempt++ {
+		tx, err := m.BeginContext(ctx, level)
+		if err != nil {
+			return err
+		}
+
+		err = tx.run(fn)
+		if err == nil || !isRetryable(err) || attempt >= retries || ctx.Err() != nil {
+			return err
+		}
+		glog.Info(fmt.Sprintf(txRetryMsg, attempt+1, err))
+	}
+}
+
+// WithTxContext runs fn in a transaction with an isolation level on the default mapper
+func WithTxContext(ctx context.Context, level sql.IsolationLevel, fn func(tx *Tx) error) error {
+	return defaultMapper.WithTxContext(ctx, level, fn)
+}
+
+// WithTx runs fn in a nested transaction (a savepoint), see Mapper.WithTx
+// It's not retried on its own, since a serialization failure aborts the outermost transaction
+func (tx *Tx) WithTx(fn func(tx *Tx) error) error {
+	nested, err := tx.Begin()
+	if err != nil {
+		return err
+	}
+	return nested.run(fn)
+}
+
+// run calls fn, then commits or rolls back
+func (tx *Tx) run(fn func(tx *Tx) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// isRetryable tells if a transaction failed in a way that running it again could fix
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && retryableCodes[pqErr.Code]
+}
@@ -0,0 +1,142 @@
+package mapper
+
+import (
+	`database/sql`
+	`errors`
+	`fmt`
+	`github.com/lib/pq`
+	`gopkg.in/check.v1`
+)
+
+type TxTS struct{}
+
+type TxExecTS struct{}
+
+func init() {
+	check.Suite(&TxTS{})
+	check.Suite(&TxExecTS{})
+}
+
+func (s *TxTS) TestIsRetryable(c *check.C) {
+	var tests = []testEntry{
+		{isRetryable(&pq.Error{Code: `40001`}), check.Equals, true},
+		{isRetryable(&pq.Error{Code: `40P01`}), check.Equals, true},
+		{isRetryable(fmt.Errorf(`insert failed: %w`, &pq.Error{Code: `40001`})), check.Equals, true},
+		{isRetryable(&pq.Error{Code: `23505`}), check.Equals, false},
+		{isRetryable(errors.New(`40001`)), check.Equals, false},
+	}
+	tableCheck(c, tests)
+}
+
+func (s *TxExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	defaultMapper = New(defaultMapper.db)
+	c.Assert(Register(`t_roles`), check.IsNil)
+}
+
+func countRoles(c *check.C) int64 {
+	count, err := Select(`t_roles.id`).From(`t_roles`).RunCount()
+	c.Assert(err, check.IsNil)
+	return count
+}
+
+func (s *TxExecTS) TestCommitRollback(c *check.C) {
+	tx, err := Begin()
+	c.Assert(err, check.IsNil)
+	_, err = tx.Exec(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100))
+	c.Assert(err, check.IsNil)
+	c.Assert(tx.Rollback(), check.IsNil)
+	c.Assert(countRoles(c), check.Equals, int64(0))
+	c.Assert(tx.Commit(), check.Equals, sql.ErrTxDone)
+
+	tx, err = BeginLevel(sql.LevelSerializable)
+	c.Assert(err, check.IsNil)
+	count, err := tx.ExecCount(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100))
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(1))
+	c.Assert(tx.Commit(), check.IsNil)
+	c.Assert(countRoles(c), check.Equals, int64(1))
+}
+
+func (s *TxExecTS) TestSavepoints(c *check.C) {
+	err := WithTx(func(tx *Tx) error {
+		if _, err := tx.Exec(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100)); err != nil {
+			return err
+		}
+
+		nestedErr := tx.WithTx(func(nested *Tx) error {
+			if _, err := nested.Exec(Insert(`t_roles`, `id, name, required_karma`, `2r`, `Bug eagle`, 1000)); err != nil {
+				return err
+			}
+			return errors.New(`undo the nested insert`)
+		})
+		c.Assert(nestedErr, check.ErrorMatches, `undo the nested insert`)
+
+		return tx.WithTx(func(nested *Tx) error {
+			_, err := nested.Exec(Insert(`t_roles`, `id, name, required_karma`, `3r`, `Code kingkong`, 500))
+			return err
+		})
+	})
+	c.Assert(err, check.IsNil)
+
+	data, err := Select(`t_roles.id`).From(`t_roles`).Order(`t_roles.id`, Asc).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 2)
+	c.Assert(data[0][`t_roles.id`], check.Equals, `1r`)
+	c.Assert(data[1][`t_roles.id`], check.Equals, `3r`)
+}
+
+func (s *TxExecTS) TestWithTxRollback(c *check.C) {
+	err := WithTx(func(tx *Tx) error {
+		tx.Exec(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100))
+		return errors.New(`failed`)
+	})
+	c.Assert(err, check.ErrorMatches, `failed`)
+	c.Assert(countRoles(c), check.Equals, int64(0))
+
+	c.Assert(func() {
+		WithTx(func(tx *Tx) error {
+			tx.Exec(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100))
+			panic(`boom`)
+		})
+	}, check.PanicMatches, `boom`)
+	c.Assert(countRoles(c), check.Equals, int64(0))
+}
+
+func (s *TxExecTS) TestWithTxRetry(c *check.C) {
+	attempts := 0
+	err := WithTxLevel(sql.LevelSerializable, func(tx *Tx) error {
+		attempts++
+		if _, err := tx.Exec(Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100)); err != nil {
+			return err
+		}
+		if attempts < 3 {
+			return &pq.Error{Code: `40001`}
+		}
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(attempts, check.Equals, 3)
+	c.Assert(countRoles(c), check.Equals, int64(1))
+
+	Configure(Configuration{MaxTxRetries: -1})
+	attempts = 0
+	err = WithTx(func(tx *Tx) error {
+		attempts++
+		return &pq.Error{Code: `40001`}
+	})
+	c.Assert(err, check.NotNil)
+	c.Assert(attempts, check.Equals, 1)
+}
+
+func (s *TxExecTS) TestCopyInTx(c *check.C) {
+	err := WithTx(func(tx *Tx) error {
+		_, err := tx.ExecCount(BulkInsert(`t_roles`, `id, name, required_karma`, [][]interface{}{{`1r`, `Code monkey`, 100}}).Copy())
+		if err != nil {
+			return err
+		}
+		return errors.New(`rollback the copy`)
+	})
+	c.Assert(err, check.ErrorMatches, `rollback the copy`)
+	c.Assert(countRoles(c), check.Equals, int64(0))
+}
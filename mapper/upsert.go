@@ -0,0 +1,97 @@
+package mapper
+
+import (
+	`fmt`
+	`strings`
+)
+
+var (
+	onConflictTemplate    = `%s ON CONFLICT (%s)`
+	onAnyConflictTemplate = `%s ON CONFLICT`
+	doNothingTemplate     = `%s DO NOTHING`
+	doUpdateTemplate      = `%s DO UPDATE SET %s`
+	excludedTemplate      = `%s = EXCLUDED.%s`
+)
+
+const (
+	conflictNotInsertErr      = `ON CONFLICT can only be used with insert and bulk insert queries`
+	conflictNotStartedErr     = `DO NOTHING / DO UPDATE must follow OnConflict`
+	conflictNoActionErr       = `OnConflict must be followed by DoNothing or DoUpdate`
+	conflictUpdateNoTargetErr = `DO UPDATE needs the conflicting columns, given to OnConflict`
+	conflictUpdateNoFieldsErr = `DO UPDATE needs at least 1 field to set`
+)
+
+// onConflict is the ON CONFLICT clause of an insert, its columns are not qualified by their table
+type onConflict struct {
+	columns   []string
+	doNothing bool
+	updates   []string // columns set to the value of the row that couldn't be inserted
+}
+
+// clause gives the ON CONFLICT clause, appended to statement
+func (c *onConflict) clause(statement string) string {
+	if len(c.columns) > 0 {
+		statement = fmt.Sprintf(onConflictTemplate, statement, strings.Join(quoteIdentifiers(c.columns), `, `))
+	} else {
+		statement = fmt.Sprintf(onAnyConflictTemplate, statement)
+	}
+	if c.doNothing {
+		return fmt.Sprintf(doNothingTemplate, statement)
+	}
+
+	sets := make([]string, 0, len(c.updates))
+	for _, column := range c.updates {
+		quoted := quoteIdentifier(column)
+		sets = append(sets, fmt.Sprintf(excludedTemplate, quoted, quoted))
+	}
+	return fmt.Sprintf(doUpdateTemplate, statement, strings.Join(sets, `, `))
+}
+
+// OnConflict makes an insert or bulk insert an upsert, its rows can conflict with existing ones
+// on columns, which must have a unique index (or be the primary key). Without columns, any conflict matches
+// It must be followed by DoNothing or DoUpdate. Columns may be qualified ("t_roles.id"), as in the other builders
+func (q *Query) OnConflict(columns ...string) *Query {
+	if q.queryType != InsertQuery && q.queryType != BulkInsertQuery {
+		q.setErr(fmt.Errorf(conflictNotInsertErr))
+		return q
+	}
+	q.conflict = &onConflict{columns: bareColumns(columns)}
+	q.fields = append(q.fields, columns...)
+	return q
+}
+
+// DoNothing skips the rows that conflict
+func (q *Query) DoNothing() *Query {
+	if q.conflict == nil {
+		q.setErr(fmt.Errorf(conflictNotStartedErr))
+		return q
+	}
+	q.conflict.doNothing = true
+	return q
+}
+
+// DoUpdate updates the existing row instead, setting fields (column names) to the values that were to be inserted
+// (EXCLUDED.field). Rows returned by RETURNING are then the inserted or updated ones
+func (q *Query) DoUpdate(fields ...string) *Query {
+	switch {
+	case q.conflict == nil:
+		q.setErr(fmt.Errorf(conflictNotStartedErr))
+	case len(q.conflict.columns) == 0:
+		q.setErr(fmt.Errorf(conflictUpdateNoTargetErr))
+	case len(fields) == 0:
+		q.setErr(fmt.Errorf(conflictUpdateNoFieldsErr))
+	default:
+		q.conflict.updates = bareColumns(fields)
+		q.fields = append(q.fields, fields...)
+	}
+	return q
+}
+
+// bareColumns removes the table (and schema) of columns: ON CONFLICT and EXCLUDED only take column names
+func bareColumns(columns []string) []string {
+	bare := make([]string, len(columns))
+	for i, column := range columns {
+		bare[i] = column[strings.LastIndex(column, `.`)+1:]
+	}
+	return bare
+}
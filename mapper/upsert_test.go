@@ -0,0 +1,96 @@
+package mapper
+
+import (
+	`gopkg.in/check.v1`
+)
+
+type UpsertTS struct{}
+
+type UpsertExecTS struct{}
+
+func init() {
+	check.Suite(&UpsertTS{})
+	check.Suite(&UpsertExecTS{})
+}
+
+func (s *UpsertTS) TestOnConflict(c *check.C) {
+	testQuery(c,
+		Insert(`t_user_roles`, `id, user_id, role_id`, `1ur`, `1u`, `1r`).OnConflict(`user_id`, `role_id`).DoNothing(),
+		InsertQuery,
+		`INSERT INTO "t_user_roles" ("id", "user_id", "role_id") VALUES ($1, $2, $3) ON CONFLICT ("user_id", "role_id") DO NOTHING`,
+		nil,
+		[]interface{}{`1ur`, `1u`, `1r`},
+	)
+
+	testQuery(c,
+		Insert(`t_roles`, `id, name, required_karma`, `1r`, `Code monkey`, 100).OnConflict(`id`).DoUpdate(`name`, `required_karma`).Returning(`id`),
+		InsertQuery,
+		`INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3) ON CONFLICT ("id") DO UPDATE SET "name" = EXCLUDED."name", "required_karma" = EXCLUDED."required_karma" RETURNING "id"`,
+		[]string{`id`},
+		[]interface{}{`1r`, `Code monkey`, 100},
+	)
+
+	testQuery(c,
+		Insert(`t_user_roles`, `id, user_id, role_id`, `1ur`, `1u`, `1r`).OnConflict(`t_user_roles.user_id`).DoUpdate(`public.t_user_roles.role_id`),
+		InsertQuery,
+		`INSERT INTO "t_user_roles" ("id", "user_id", "role_id") VALUES ($1, $2, $3) ON CONFLICT ("user_id") DO UPDATE SET "role_id" = EXCLUDED."role_id"`,
+		nil,
+		[]interface{}{`1ur`, `1u`, `1r`},
+	)
+
+	q := BulkInsert(`t_roles`, `id, name, required_karma`, [][]interface{}{{`1r`, `Code monkey`, 100}, {`2r`, `Bug eagle`, 1000}}).OnConflict().DoNothing()
+	c.Assert(q.bulk.statements(q.sql()), check.DeepEquals, []statement{{
+		query: `INSERT INTO "t_roles" ("id", "name", "required_karma") VALUES ($1, $2, $3), ($4, $5, $6) ON CONFLICT DO NOTHING`,
+		args:  []interface{}{`1r`, `Code monkey`, 100, `2r`, `Bug eagle`, 1000},
+	}})
+}
+
+func (s *UpsertTS) TestOnConflictErrors(c *check.C) {
+	c.Assert(Update(`t_roles`, `name = ?`, `x`).OnConflict(`id`).err, check.ErrorMatches, `ON CONFLICT can only be used with insert and bulk insert queries`)
+	c.Assert(Insert(`t_roles`, `id`, `1r`).DoNothing().err, check.ErrorMatches, `DO NOTHING / DO UPDATE must follow OnConflict`)
+	c.Assert(Insert(`t_roles`, `id`, `1r`).OnConflict().DoUpdate(`name`).err, check.ErrorMatches, `DO UPDATE needs the conflicting columns.*`)
+	c.Assert(Insert(`t_roles`, `id`, `1r`).OnConflict(`id`).DoUpdate().err, check.ErrorMatches, `DO UPDATE needs at least 1 field to set`)
+
+	m := New(nil)
+	m.registry.add(map[string]int{`public.t_roles.id`: StringType, `public.t_roles.name`: StringType})
+	c.Assert(m.checkQuery(m.Insert(`t_roles`, `id, name`, `1r`, `x`).OnConflict(`id`)), check.ErrorMatches, `OnConflict must be followed by DoNothing or DoUpdate`)
+	c.Assert(m.checkQuery(m.Insert(`t_roles`, `id, name`, `1r`, `x`).OnConflict(`code`).DoNothing()), check.ErrorMatches, `field "code" is not a registered column.*`)
+	c.Assert(m.checkQuery(m.Insert(`t_roles`, `id, name`, `1r`, `x`).OnConflict(`id`).DoUpdate(`name = 'x'`)), check.ErrorMatches, `field "name = 'x'" is not a registered column.*`)
+	c.Assert(m.checkQuery(m.Insert(`t_roles`, `id, name`, `1r`, `x`).OnConflict(`id`).DoUpdate(`name`)), check.IsNil)
+	c.Assert(m.checkQuery(m.Insert(`t_roles`, `id, name`, `1r`, `x`).OnConflict(`t_roles.id`).DoUpdate(`t_roles.name`)), check.IsNil)
+}
+
+func (s *UpsertExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_roles`), check.IsNil)
+	c.Assert(Register(`t_user_roles`), check.IsNil)
+	exec(`INSERT INTO t_roles (id, name, required_karma) VALUES ($1, $2, $3)`, `1r`, `Code monkey`, 100)
+	exec(`INSERT INTO t_user_roles (id, user_id, role_id) VALUES ($1, $2, $3)`, `1ur`, `1u`, `1r`)
+}
+
+func (s *UpsertExecTS) TestDoNothing(c *check.C) {
+	count, err := Insert(`t_user_roles`, `id, user_id, role_id`, `2ur`, `1u`, `1r`).OnConflict(`user_id`, `role_id`).DoNothing().RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(0))
+
+	count, err = BulkInsert(`t_user_roles`, `id, user_id, role_id`, [][]interface{}{{`2ur`, `1u`, `1r`}, {`3ur`, `1u`, `2r`}}).
+		OnConflict(`user_id`, `role_id`).DoNothing().RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(1))
+}
+
+func (s *UpsertExecTS) TestDoUpdate(c *check.C) {
+	data, err := BulkInsert(`t_roles`, `id, name, required_karma`, [][]interface{}{{`1r`, `Code kingkong`, 500}, {`2r`, `Bug eagle`, 1000}}).
+		OnConflict(`id`).DoUpdate(`name`, `required_karma`).Returning(`id`, `name`, `required_karma`).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 2)
+	c.Assert(data[0][`name`], check.Equals, `Code kingkong`)
+	c.Assert(data[0][`required_karma`], check.Equals, int64(500))
+
+	count, err := Select(`t_roles.id`).From(`t_roles`).RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(2))
+
+	_, err = BulkInsert(`t_roles`, `id, name, required_karma`, [][]interface{}{{`1r`, `x`, 1}}).OnConflict(`id`).DoNothing().Copy().RunCount()
+	c.Assert(err, check.ErrorMatches, `COPY cannot be used with RETURNING or ON CONFLICT`)
+}
@@ -0,0 +1,133 @@
+package mapper
+
+import (
+	`fmt`
+	`strings`
+)
+
+var (
+	withTemplate = `WITH %s %s`
+	cteTemplate  = `%s AS %s`
+)
+
+const (
+	cteNameErr = `invalid name for a WITH query: %q`
+)
+
+// CTE is the WITH clause of a query, naming queries (common table expressions) the main query reads from
+// like from tables. It's started with With, and ended by Select
+type CTE struct {
+	mapper  *Mapper
+	names   []string
+	queries []*Query
+	parts   []string
+	args    []interface{}
+	err     error
+}
+
+// With starts a query which reads from q, under name:
+// With(`active_users`, Select(`t_users.id`).From(`t_users`).Where(`t_users.active`)).Select(`active_users.id`).From(`active_users`)
+// The types of the columns of q are the ones it selects, its fields are named as in postgres (the column name, or the alias)
+func (m *Mapper) With(name string, q *Query) *CTE {
+	return (&CTE{mapper: m}).With(name, q)
+}
+
+// With starts a query with a WITH clause on the default mapper
+func With(name string, q *Query) *CTE {
+	return defaultMapper.With(name, q)
+}
+
+// With adds another query to the WITH clause, it can read from the ones before
+func (w *CTE) With(name string, q *Query) *CTE {
+	if !identifierPattern.MatchString(name) || strings.Contains(name, `.`) {
+		w.setErr(fmt.Errorf(cteNameErr, name))
+		return w
+	}
+
+	text, args, _, err := bindArgs(placeHolder, len(w.args)+1, []interface{}{q})
+	if err != nil {
+		w.setErr(err)
+		return w
+	}
+	w.names = append(w.names, name)
+	w.queries = append(w.queries, q)
+	w.parts = append(w.parts, fmt.Sprintf(cteTemplate, quoteIdentifier(name), text))
+	w.args = append(w.args, args...)
+	return w
+}
+
+// Select starts the main query, see Mapper.Select
+func (w *CTE) Select(fields ...string) *Query {
+	exprs := make([]Expression, len(fields))
+	for i, field := range fields {
+		exprs[i] = Column(field)
+	}
+	return w.SelectExpr(exprs...)
+}
+
+// SelectExpr starts the main query, see Mapper.SelectExpr
+func (w *CTE) SelectExpr(fields ...Expression) *Query {
+	q := w.mapper.SelectExpr(fields...)
+	q.setErr(w.err)
+	q.with = w
+	q.args = append([]interface{}{}, w.args...)
+	q.subQueries = append(q.subQueries, w.queries...)
+	return q
+}
+
+// setErr records an error found while building the clause, only the first one is kept
+func (w *CTE) setErr(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// query gives the query named name, or nil
+func (w *CTE) query(name string) *Query {
+	for i, n := range w.names {
+		if n == name {
+			return w.queries[i]
+		}
+	}
+	return nil
+}
+
+// clause gives the WITH clause, put before statement
+func (w *CTE) clause(statement string) string {
+	return fmt.Sprintf(withTemplate, strings.Join(w.parts, `, `), statement)
+}
+
+// cteColumnType finds the type of a field of the query when it's a column of one of its WITH queries
+func (m *Mapper) cteColumnType(query *Query, field string) (int, bool) {
+	parts := strings.Split(field, `.`)
+	if len(parts) > 2 {
+		return invalidType, false
+	}
+	column := parts[len(parts)-1]
+
+	for _, tb := range query.tables {
+		sub := query.with.query(tb.name)
+		if tb.schema != `` || sub == nil || (len(parts) == 2 && parts[0] != tb.name) {
+			continue
+		}
+		for _, key := range sub.selectFields {
+			if cteColumnName(key) != column {
+				continue
+			}
+			colType, ok := m.fieldType(sub, key)
+			if ok && tb.outer {
+				colType = nullableType(colType)
+			}
+			return colType, ok
+		}
+	}
+	return invalidType, false
+}
+
+// cteColumnName gives the name postgres gives to a field selected by a WITH query, "t_users.id" is "id"
+func cteColumnName(key string) string {
+	if identifierPattern.MatchString(key) {
+		return key[strings.LastIndex(key, `.`)+1:]
+	}
+	return key
+}
@@ -0,0 +1,140 @@
+package mapper
+
+import (
+	`gopkg.in/check.v1`
+)
+
+type SubQueryTS struct{}
+
+type SubQueryExecTS struct{}
+
+func init() {
+	check.Suite(&SubQueryTS{})
+	check.Suite(&SubQueryExecTS{})
+}
+
+func (s *SubQueryTS) TestWhereSubQuery(c *check.C) {
+	roleUsers := Select(`t_user_roles.user_id`).From(`t_user_roles`).Where(`t_user_roles.role_id = ?`, `1r`)
+	testQuery(c,
+		Select(`t_users.id`).From(`t_users`).Where(`t_users.age > ?`, 18).AndWhere(`t_users.id IN ?`, roleUsers).AndWhere(`t_users.active = ?`, true),
+		SelectQuery,
+		`SELECT "t_users"."id" FROM "t_users" WHERE (t_users.age > $1) AND (t_users.id IN (SELECT "t_user_roles"."user_id" FROM "t_user_roles" WHERE t_user_roles.role_id = $2)) AND (t_users.active = $3)`,
+		[]string{`t_users.id`},
+		[]interface{}{18, `1r`, true},
+	)
+
+	testQuery(c,
+		Select(`t_users.id`).From(`t_users`).Where(And(Eq(`t_users.active`, true), In(`t_users.id`, roleUsers))),
+		SelectQuery,
+		`SELECT "t_users"."id" FROM "t_users" WHERE "t_users"."active" = $1 AND "t_users"."id" IN (SELECT "t_user_roles"."user_id" FROM "t_user_roles" WHERE t_user_roles.role_id = $2)`,
+		[]string{`t_users.id`},
+		[]interface{}{true, `1r`},
+	)
+
+	testQuery(c,
+		Select(`t_roles.id`).From(`t_roles`).Where(Not(Exists(Select(`t_user_roles.id`).From(`t_user_roles`).Where(`t_user_roles.role_id = t_roles.id`)))),
+		SelectQuery,
+		`SELECT "t_roles"."id" FROM "t_roles" WHERE NOT (EXISTS (SELECT "t_user_roles"."id" FROM "t_user_roles" WHERE t_user_roles.role_id = t_roles.id))`,
+		[]string{`t_roles.id`},
+		nil,
+	)
+
+	testQuery(c,
+		Update(`t_users`, `age = ?, active = ?`, SelectExpr(Max(`t_users.age`, Int64Type)).From(`t_users`).Where(`t_users.active = ?`, true), false).Where(`t_users.id = ?`, `1u`),
+		UpdateQuery,
+		`UPDATE "t_users" SET age = (SELECT max("t_users"."age") FROM "t_users" WHERE t_users.active = $1), active = $2 WHERE t_users.id = $3`,
+		nil,
+		[]interface{}{true, false, `1u`},
+	)
+}
+
+func (s *SubQueryTS) TestWith(c *check.C) {
+	active := Select(`t_users.id`, `t_users.age`).From(`t_users`).Where(`t_users.active = ?`, true)
+	adults := Select(`active_users.id`).From(`active_users`).Where(`active_users.age >= ?`, 18)
+	testQuery(c,
+		With(`active_users`, active).With(`adults`, adults).Select(`adults.id`).From(`adults`).Where(`adults.id <> ?`, `1u`).Limit(10),
+		SelectQuery,
+		`WITH "active_users" AS (SELECT "t_users"."id", "t_users"."age" FROM "t_users" WHERE t_users.active = $1), `+
+			`"adults" AS (SELECT "active_users"."id" FROM "active_users" WHERE active_users.age >= $2) `+
+			`SELECT "adults"."id" FROM "adults" WHERE adults.id <> $3 LIMIT 10`,
+		[]string{`adults.id`},
+		[]interface{}{true, 18, `1u`},
+	)
+}
+
+func (s *SubQueryTS) TestCTEColumnType(c *check.C) {
+	m := New(nil)
+	m.registry.add(map[string]int{
+		`public.t_users.id`:  StringType,
+		`public.t_users.age`: Int64Type,
+		`public.t_roles.id`:  StringType,
+	})
+
+	active := m.SelectExpr(Column(`t_users.id`), As(`t_users.age`, `years`), Count(`t_users.id`).As(`users`)).From(`t_users`).GroupBy(`t_users.id`, `t_users.age`)
+	q := m.With(`active_users`, active).Select(`active_users.id`, `years`, `active_users.users`).
+		From(`t_roles`).Join(LeftJoin, `active_users`, `active_users.id = t_roles.id`)
+	c.Assert(m.checkQuery(q), check.IsNil)
+
+	var tests = []struct {
+		field   string
+		colType int
+		ok      bool
+	}{
+		{`active_users.id`, NullStringType, true},
+		{`years`, NullInt64Type, true},
+		{`active_users.users`, NullInt64Type, true},
+		{`active_users.name`, invalidType, false},
+	}
+	for _, test := range tests {
+		colType, ok := m.fieldType(q, test.field)
+		c.Assert(ok, check.Equals, test.ok)
+		c.Assert(colType, check.Equals, test.colType)
+	}
+}
+
+func (s *SubQueryTS) TestSubQueryErrors(c *check.C) {
+	bulk := BulkInsert(`t_roles`, `id, name`, [][]interface{}{{`1r`, `x`}})
+	c.Assert(Select(`t_users.id`).From(`t_users`).Where(`t_users.id IN ?`, bulk).err, check.ErrorMatches, `a bulk insert cannot be used as a subquery`)
+	c.Assert(With(`active_users`, bulk).Select(`active_users.id`).err, check.ErrorMatches, `a bulk insert cannot be used as a subquery`)
+	c.Assert(With(`active users`, Select(`t_users.id`).From(`t_users`)).Select(`id`).err, check.ErrorMatches, `invalid name for a WITH query: "active users"`)
+
+	m := New(nil)
+	m.registry.add(map[string]int{`public.t_users.id`: StringType})
+	sub := m.Select(`t_roles.id`).From(`t_roles`)
+	c.Assert(m.checkQuery(m.Select(`t_users.id`).From(`t_users`).Where(Exists(sub))), check.ErrorMatches, `table "t_roles" is not registered.*`)
+	c.Assert(m.checkQuery(m.With(`roles`, sub).Select(`roles.id`).From(`roles`)), check.ErrorMatches, `table "t_roles" is not registered.*`)
+}
+
+func (s *SubQueryExecTS) SetUpTest(c *check.C) {
+	createTestTables()
+	c.Assert(Register(`t_users`), check.IsNil)
+	c.Assert(Register(`t_user_roles`), check.IsNil)
+	for _, row := range [][]interface{}{{`1u`, `a@viki.com`, 20, true}, {`2u`, `b@viki.com`, 30, true}, {`3u`, `c@viki.com`, 40, false}} {
+		exec(`INSERT INTO t_users (id, email, age, active, created_at) VALUES ($1, $2, $3, $4, $5)`, append(row, testTime)...)
+	}
+	exec(`INSERT INTO t_user_roles (id, user_id, role_id) VALUES ($1, $2, $3)`, `1ur`, `2u`, `1r`)
+	exec(`INSERT INTO t_user_roles (id, user_id, role_id) VALUES ($1, $2, $3)`, `2ur`, `3u`, `1r`)
+}
+
+func (s *SubQueryExecTS) TestSubQuery(c *check.C) {
+	roleUsers := Select(`t_user_roles.user_id`).From(`t_user_roles`).Where(`t_user_roles.role_id = ?`, `1r`)
+	data, err := Select(`t_users.id`).From(`t_users`).Where(`t_users.active = ?`, true).AndWhere(`t_users.id IN ?`, roleUsers).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`t_users.id`], check.Equals, `2u`)
+
+	count, err := Select(`t_users.id`).From(`t_users`).
+		Where(Not(Exists(Select(`t_user_roles.id`).From(`t_user_roles`).Where(`t_user_roles.user_id = t_users.id`)))).RunCount()
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, int64(1))
+}
+
+func (s *SubQueryExecTS) TestWith(c *check.C) {
+	active := SelectExpr(Column(`t_users.id`), As(`t_users.age`, `years`)).From(`t_users`).Where(`t_users.active = ?`, true)
+	data, err := With(`active_users`, active).Select(`active_users.id`, `active_users.years`).From(`active_users`).
+		Where(`active_users.years > ?`, 25).Run()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(data), check.Equals, 1)
+	c.Assert(data[0][`active_users.id`], check.Equals, `2u`)
+	c.Assert(data[0][`active_users.years`], check.Equals, int64(30))
+}
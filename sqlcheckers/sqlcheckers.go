@@ -2,6 +2,7 @@
 package sqlcheckers
 
 import (
+	`bytes`
 	`database/sql`
 	`fmt`
 	`github.com/lib/pq`
@@ -15,12 +16,14 @@ type sqlEqualsChecker struct {
 }
 
 const (
-	unsupportedType = `unsupported type %v, type must be one of {'sql.NullString', 'sql.NullBool'. 'sql.NullInt64'. 'pq.NullTime'}`
+	unsupportedType = `unsupported type %v, type must be one of {'sql.NullString', 'sql.NullBool'. 'sql.NullInt64'. 'sql.NullFloat64', 'pq.NullTime', 'time.Time', '[]byte'}`
+	nilMismatch     = `nil not equal, obtained == nil is %v, expected == nil is %v`
 	typeMismatch    = `type mismatched: obtained type %v, comparing to type %v`
 	invalidMsg      = `Valid not equal, obtained.Valid = %v, expected.Valid = %v`
 )
 
-// SQLEquals is a checker that helps checking equality of sql.NullString, sql.NullBool, sql.NullInt64 and pq.NullTime
+// SQLEquals is a checker that helps checking equality of sql.NullString, sql.NullBool, sql.NullInt64, sql.NullFloat64 and pq.NullTime
+// It also compares time.Time by instant and []byte by content, where a nil slice (NULL) only equals nil
 var SQLEquals = &sqlEqualsChecker{
 	&gocheck.CheckerInfo{
 		Name:   `SQLEquals`,
@@ -42,10 +45,14 @@ func (checker *sqlEqualsChecker) Check(params []interface{}, names []string) (re
 		return nullBoolEqual(obtained.(sql.NullBool), expected.(sql.NullBool))
 	case sql.NullInt64:
 		return nullInt64Equal(obtained.(sql.NullInt64), expected.(sql.NullInt64))
+	case sql.NullFloat64:
+		return nullFloat64Equal(obtained.(sql.NullFloat64), expected.(sql.NullFloat64))
 	case pq.NullTime:
 		return nullTimeEqual(obtained.(pq.NullTime), expected.(pq.NullTime))
 	case time.Time:
 		return timeEqual(obtained.(time.Time), expected.(time.Time))
+	case []byte:
+		return bytesEqual(obtained.([]byte), expected.([]byte))
 	}
 
 	return false, fmt.Sprintf(unsupportedType, reflect.TypeOf(obtained))
@@ -97,6 +104,21 @@ func nullInt64Equal(obtained, expected sql.NullInt64) (result bool, err string)
 	return compareValue(obtained.Int64, expected.Int64)
 }
 
+func nullFloat64Equal(obtained, expected sql.NullFloat64) (result bool, err string) {
+	if done, res, err := compareValid(obtained.Valid, expected.Valid); done {
+		return res, err
+	}
+	return compareValue(obtained.Float64, expected.Float64)
+}
+
+// a nil slice is what a NULL bytea column gives, so it's not the same as an empty one
+func bytesEqual(obtained, expected []byte) (result bool, err string) {
+	if (obtained == nil) != (expected == nil) {
+		return false, fmt.Sprintf(nilMismatch, obtained == nil, expected == nil)
+	}
+	return bytes.Equal(obtained, expected), ``
+}
+
 // for time, just check if when convert to UTC, the no of seconds is the same
 // otherwise, we need to check for the location in time.Time as well
 // this location changes depending the timezone of the maching running the test